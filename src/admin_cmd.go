@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// mapSummary is a line of `map-sync inspect`.
+type mapSummary struct {
+	Node     string `json:"node"`
+	Map      string `json:"map"`
+	Type     string `json:"type"`
+	Entries  int    `json:"entries"`
+	Checksum string `json:"checksum"`
+}
+
+// entryDiff is a line of `map-sync diff`. A missing value means the key is
+// absent on that node. Keys and values are decoded with the map's BTF if it
+// has any, hex otherwise.
+type entryDiff struct {
+	Map    string  `json:"map"`
+	Key    string  `json:"key"`
+	ValueA *string `json:"a"`
+	ValueB *string `json:"b"`
+}
+
+// checksum hashes the entries of a map independently of their order, so the
+// same contents give the same checksum on every node.
+func checksum(entries []*Entry) string {
+	sorted := append([]*Entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].GetKey(), sorted[j].GetKey()) < 0 })
+	h := sha256.New()
+	for _, e := range sorted {
+		h.Write(e.GetKey())
+		h.Write(e.GetValue())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func dumpNode(addr string, tlsConfig *TLSConfig) *Snapshot {
+	client, conn := dialDaemon(addr, tlsConfig)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	snap, err := client.Dump(ctx, &Empty{})
+	if err != nil {
+		log.Fatalf("Failed to dump maps of %s: %v", addr, err)
+	}
+	return snap
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// inspectCommand implements `map-sync inspect`.
+func inspectCommand(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	nodes := fs.String("nodes", "localhost:50051", "Comma separated addresses of the daemons to inspect")
+	mapName := fs.String("map", "", "Only show this map")
+	output := fs.String("o", "table", "Output format, table or json")
+	tlsConfig := tlsFlags(fs)
+	fs.Parse(args)
+
+	var summaries []mapSummary
+	for _, addr := range strings.Split(*nodes, ",") {
+		for _, m := range dumpNode(addr, tlsConfig).GetMaps() {
+			if *mapName != "" && m.GetName() != *mapName {
+				continue
+			}
+			summaries = append(summaries, mapSummary{
+				Node:     addr,
+				Map:      m.GetName(),
+				Type:     m.GetType(),
+				Entries:  len(m.GetEntries()),
+				Checksum: checksum(m.GetEntries()),
+			})
+		}
+	}
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Map < summaries[j].Map })
+
+	if *output == "json" {
+		printJSON(summaries)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MAP\tNODE\tTYPE\tENTRIES\tCHECKSUM")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", s.Map, s.Node, s.Type, s.Entries, s.Checksum)
+	}
+	w.Flush()
+}
+
+// diffCommand implements `map-sync diff`.
+func diffCommand(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	a := fs.String("a", "", "Address of the first daemon")
+	b := fs.String("b", "", "Address of the second daemon")
+	mapName := fs.String("map", "", "Only compare this map")
+	output := fs.String("o", "table", "Output format, table or json")
+	tlsConfig := tlsFlags(fs)
+	fs.Parse(args)
+
+	if *a == "" || *b == "" {
+		log.Fatal("-a and -b are required")
+	}
+
+	// Entries by map and key, and the layout of every map to print them.
+	layouts := make(map[string]*mapLayout)
+	index := func(snap *Snapshot) map[string]map[string]string {
+		maps := make(map[string]map[string]string)
+		for _, m := range snap.GetMaps() {
+			if *mapName != "" && m.GetName() != *mapName {
+				continue
+			}
+			if layouts[m.GetName()] == nil {
+				layout, err := unmarshalMapLayout(m.GetBtf(), m.GetBtfKeyTypeId(), m.GetBtfValueTypeId())
+				if err != nil {
+					log.Printf("Can't read the BTF of map %s, printing it as hex: %v", m.GetName(), err)
+				}
+				layouts[m.GetName()] = layout
+			}
+			entries := make(map[string]string, len(m.GetEntries()))
+			for _, e := range m.GetEntries() {
+				entries[string(e.GetKey())] = string(e.GetValue())
+			}
+			maps[m.GetName()] = entries
+		}
+		return maps
+	}
+	mapsA, mapsB := index(dumpNode(*a, tlsConfig)), index(dumpNode(*b, tlsConfig))
+	newDiff := func(name, key string, va, vb *string) entryDiff {
+		layout := layouts[name]
+		d := entryDiff{Map: name, Key: layout.formatKey([]byte(key))}
+		if va != nil {
+			s := layout.formatValue([]byte(*va))
+			d.ValueA = &s
+		}
+		if vb != nil {
+			s := layout.formatValue([]byte(*vb))
+			d.ValueB = &s
+		}
+		return d
+	}
+
+	var diffs []entryDiff
+	names := make(map[string]bool)
+	for name := range mapsA {
+		names[name] = true
+	}
+	for name := range mapsB {
+		names[name] = true
+	}
+	for name := range names {
+		entriesA, entriesB := mapsA[name], mapsB[name]
+		if entriesA == nil || entriesB == nil {
+			fmt.Fprintf(os.Stderr, "map %s is only synchronized by one of the nodes\n", name)
+		}
+		for key, va := range entriesA {
+			vb, ok := entriesB[key]
+			if !ok {
+				diffs = append(diffs, newDiff(name, key, &va, nil))
+			} else if va != vb {
+				diffs = append(diffs, newDiff(name, key, &va, &vb))
+			}
+		}
+		for key, vb := range entriesB {
+			if _, ok := entriesA[key]; !ok {
+				diffs = append(diffs, newDiff(name, key, nil, &vb))
+			}
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Map != diffs[j].Map {
+			return diffs[i].Map < diffs[j].Map
+		}
+		return diffs[i].Key < diffs[j].Key
+	})
+
+	if *output == "json" {
+		printJSON(diffs)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "MAP\tKEY\t%s\t%s\n", *a, *b)
+		show := func(v *string) string {
+			if v == nil {
+				return "-"
+			}
+			return *v
+		}
+		for _, d := range diffs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Map, d.Key, show(d.ValueA), show(d.ValueB))
+		}
+		w.Flush()
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/link"
+)
+
+// hookFunctions are the kernel functions updating and deleting hash map
+// entries, each with the programs of bpf/sync.c reporting them by attach
+// mode. Both kinds of programs report identical events.
+var hookFunctions = []struct {
+	symbol string
+	progs  map[string]string
+}{
+	{"htab_map_update_elem", map[string]string{ATTACH_FENTRY: "bpf_prog_kern_hmapupdate", ATTACH_KPROBE: "bpf_prog_kprobe_hmapupdate"}},
+	{"htab_map_delete_elem", map[string]string{ATTACH_FENTRY: "bpf_prog_kern_hmapdelete", ATTACH_KPROBE: "bpf_prog_kprobe_hmapdelete"}},
+}
+
+// hooks are the programs reporting changes of hash maps, attached to the
+// kernel.
+type hooks struct {
+	mode  string
+	progs []*ebpf.Program
+	links []link.Link
+}
+
+func (h *hooks) Close() error {
+	var errs []error
+	for _, l := range h.links {
+		errs = append(errs, l.Close())
+	}
+	for _, p := range h.progs {
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// loadObjects loads the maps of bpf/sync.c and attaches the programs
+// reporting their changes the given way. In auto mode, fentry programs are
+// used if the kernel supports them, and kprobes otherwise.
+func loadObjects(mode string) (syncMaps, *hooks, error) {
+	if mode != "" && mode != ATTACH_AUTO {
+		return loadHooked(mode)
+	}
+	// Tracing programs may still fail to attach, e.g. on arm64 kernels
+	// without BPF trampolines.
+	if err := features.HaveProgramType(ebpf.Tracing); err != nil {
+		kernelLog.Info("The kernel has no fentry support, attaching kprobes", "error", err)
+		return loadHooked(ATTACH_KPROBE)
+	}
+	maps, h, err := loadHooked(ATTACH_FENTRY)
+	if err == nil {
+		return maps, h, nil
+	}
+	kernelLog.Warn("Failed to attach fentry programs, attaching kprobes instead", "error", err)
+	return loadHooked(ATTACH_KPROBE)
+}
+
+// loadHooked loads the maps of bpf/sync.c with the programs of one attach
+// mode, leaving the others out since the kernel may refuse them.
+func loadHooked(mode string) (syncMaps, *hooks, error) {
+	var maps syncMaps
+	spec, err := loadSync()
+	if err != nil {
+		return maps, nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, f := range hookFunctions {
+		wanted[f.progs[mode]] = true
+	}
+	for name := range spec.Programs {
+		if !wanted[name] {
+			delete(spec.Programs, name)
+		}
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return maps, nil, fmt.Errorf("loading %s programs: %w", mode, err)
+	}
+	// Only frees what wasn't handed over.
+	defer coll.Close()
+	if err := coll.Assign(&maps); err != nil {
+		return maps, nil, err
+	}
+
+	h := &hooks{mode: mode}
+	for _, f := range hookFunctions {
+		prog := coll.DetachProgram(f.progs[mode])
+		h.progs = append(h.progs, prog)
+		var l link.Link
+		switch mode {
+		case ATTACH_FENTRY:
+			l, err = link.AttachTracing(link.TracingOptions{Program: prog})
+		case ATTACH_KPROBE:
+			l, err = link.Kprobe(f.symbol, prog, nil)
+		}
+		if err != nil {
+			h.Close()
+			maps.Close()
+			return syncMaps{}, nil, fmt.Errorf("attaching %s to %s: %w", mode, f.symbol, err)
+		}
+		h.links = append(h.links, l)
+	}
+	attachMode.Set(mode)
+	kernelLog.Info("Attached to hash map changes", "mode", mode)
+	return maps, h, nil
+}
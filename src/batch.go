@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher collects local changes for a window before handing them to the
+// peers, keeping only the last change of every key. Hot keys, e.g. a
+// connection's byte counter, then cost one change per window instead of one
+// per write.
+type batcher struct {
+	window  time.Duration
+	maxSize int
+	flush   func([]*ValueRequest)
+
+	mu      sync.Mutex
+	pending []*ValueRequest
+	index   map[string]int // Into pending, by map and key
+	started chan struct{}  // Signaled by the first pending change
+	full    chan struct{}  // Signaled when maxSize changes are pending
+}
+
+func newBatcher(window time.Duration, maxSize int, flush func([]*ValueRequest)) *batcher {
+	return &batcher{
+		window:  window,
+		maxSize: maxSize,
+		flush:   flush,
+		index:   make(map[string]int),
+		started: make(chan struct{}, 1),
+		full:    make(chan struct{}, 1),
+	}
+}
+
+func (b *batcher) add(req *ValueRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	k := req.GetMap() + "\x00" + string(req.GetKeyData())
+	if i, ok := b.index[k]; ok {
+		b.pending[i] = req
+		coalescedChanges.Add(1)
+		return
+	}
+	b.index[k] = len(b.pending)
+	b.pending = append(b.pending, req)
+	if len(b.pending) == 1 {
+		wake(b.started)
+	}
+	if len(b.pending) >= b.maxSize {
+		wake(b.full)
+	}
+}
+
+func (b *batcher) take() []*ValueRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	reqs := b.pending
+	b.pending = nil
+	clear(b.index)
+	return reqs
+}
+
+func (b *batcher) isFull() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.pending) >= b.maxSize
+}
+
+// run flushes the pending changes a window after the first one, or as soon
+// as there are maxSize of them. Flushing from a single goroutine keeps the
+// batches in order.
+func (b *batcher) run() {
+	for range b.started {
+		// Drop a signal left from the last window, whose changes were taken
+		// already, but don't miss that this one filled up in the meantime.
+		select {
+		case <-b.full:
+		default:
+		}
+		if !b.isFull() {
+			select {
+			case <-time.After(b.window):
+			case <-b.full:
+			}
+		}
+		if reqs := b.take(); len(reqs) > 0 {
+			b.flush(reqs)
+		}
+	}
+}
+
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatcherCoalesces(t *testing.T) {
+	b := newBatcher(time.Hour, 10, nil)
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("a"), ValueData: []byte("1")})
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("b"), ValueData: []byte("1")})
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("a"), ValueData: []byte("2")})
+	b.add(&ValueRequest{Map: "n", KeyData: []byte("a"), ValueData: []byte("1")})
+
+	var got []string
+	for _, req := range b.take() {
+		got = append(got, req.GetMap()+"/"+string(req.GetKeyData())+"="+string(req.GetValueData()))
+	}
+	if want := []string{"m/a=2", "m/b=1", "n/a=1"}; !equalKeys(got, want) {
+		t.Errorf("took %v, want %v", got, want)
+	}
+}
+
+func TestBatcherFlushesWhenFull(t *testing.T) {
+	flushed := make(chan []*ValueRequest, 10)
+	b := newBatcher(time.Hour, 2, func(reqs []*ValueRequest) { flushed <- reqs })
+	// A window whose changes were taken after it filled up.
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("a")})
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("b")})
+	b.take()
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("c")})
+	go b.run()
+
+	select {
+	case reqs := <-flushed:
+		t.Fatalf("flushed %d changes before the window ended or it filled up", len(reqs))
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.add(&ValueRequest{Map: "m", KeyData: []byte("d")})
+	select {
+	case reqs := <-flushed:
+		if len(reqs) != 2 {
+			t.Errorf("flushed %d changes, want 2", len(reqs))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch not flushed")
+	}
+}
@@ -27,6 +27,22 @@ struct {
   __uint(max_entries, 10240);
 } hash_map SEC(".maps");
 
+/* IDs of the maps to report changes of, filled in by userspace */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, __u8);
+  __uint(max_entries, MAX_SYNCED_MAPS);
+} map_allowlist SEC(".maps");
+
+/* Filter rules of the maps in the allowlist that have some, filled in by userspace */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, struct Filter);
+  __uint(max_entries, MAX_SYNCED_MAPS);
+} map_filters SEC(".maps");
+
 #define MEM_READ(P)                                                            \
   ({                                                                           \
     typeof(P) val = 0;                                                         \
@@ -34,9 +50,42 @@ struct {
     val;                                                                       \
   })
 
+static bool __always_inline rule_matches(struct FilterRule *rule,
+                                         struct MapData *data) {
+  unsigned char *b = data->key;
+  __u32 size = data->key_size;
+  if (rule->in_value) {
+    // Deletes have no value to match.
+    if (data->update_type == MAP_DELETE)
+      return false;
+    b = data->value;
+    size = data->value_size;
+  }
+  if (rule->offset + rule->len > size)
+    return false;
+  for (int i = 0; i < MAX_FILTER_BYTES && i < rule->len; i++) {
+    // The mask keeps the verifier sure we stay within the record.
+    __u32 off = (rule->offset + i) & (MAX_VALUE_SIZE - 1);
+    if ((b[off] & rule->mask[i]) != rule->match[i])
+      return false;
+  }
+  return true;
+}
+
+// Whether the filter rules of the map keep the change local.
+static bool __always_inline skipped(struct MapData *data) {
+  struct Filter *filter = bpf_map_lookup_elem(&map_filters, &data->map_id);
+  if (!filter)
+    return false;
+  for (int i = 0; i < MAX_FILTER_RULES && i < filter->count; i++) {
+    if (rule_matches(&filter->rules[i], data))
+      return filter->rules[i].action == FILTER_ACTION_SKIP;
+  }
+  return false;
+}
+
 static void __always_inline log_map_update(struct bpf_map *updated_map,
-                                           unsigned int *pKey,
-                                           unsigned int *pValue,
+                                           void *pKey, void *pValue,
                                            enum map_updater update_type) {
   // This prevents the proxy from proxying itself
   __u32 key = 0;
@@ -48,8 +97,13 @@ static void __always_inline log_map_update(struct bpf_map *updated_map,
 
   // Get basic info about the map
   uint32_t map_id = MEM_READ(updated_map->id);
+  if (!bpf_map_lookup_elem(&map_allowlist, &map_id))
+    return;
+
   uint32_t key_size = MEM_READ(updated_map->key_size);
   uint32_t value_size = MEM_READ(updated_map->value_size);
+  if (key_size > MAX_KEY_SIZE || value_size > MAX_VALUE_SIZE)
+    return;
 
   struct MapData *out_data;
   out_data = bpf_ringbuf_reserve(&map_events, sizeof(*out_data), 0);
@@ -59,16 +113,23 @@ static void __always_inline log_map_update(struct bpf_map *updated_map,
   }
 
   bpf_probe_read_str(out_data->name, BPF_NAME_LEN, updated_map->name);
-  bpf_probe_read(&out_data->key, sizeof(*pKey), pKey);
+  bpf_probe_read(out_data->key, key_size, pKey);
   out_data->key_size = key_size;
   if (pValue != 0) {
-    bpf_probe_read(&out_data->value, sizeof(*pValue), pValue);
+    bpf_probe_read(out_data->value, value_size, pValue);
     out_data->value_size = value_size;
+  } else {
+    out_data->value_size = 0;
   }
   out_data->map_id = map_id;
   out_data->pid = (unsigned int)(bpf_get_current_pid_tgid() >> 32);
   out_data->update_type = update_type;
 
+  if (skipped(out_data)) {
+    bpf_ringbuf_discard(out_data, 0);
+    return;
+  }
+
   // Write data to be processed in userspace
   bpf_ringbuf_submit(out_data, 0);
 }
@@ -76,16 +137,26 @@ static void __always_inline log_map_update(struct bpf_map *updated_map,
 SEC("fentry/htab_map_update_elem")
 int BPF_PROG(bpf_prog_kern_hmapupdate, struct bpf_map *map, void *key,
              void *value, u64 map_flags) {
-  bpf_printk("htab_map_update_elem\n");
-
   log_map_update(map, key, value, MAP_UPDATE);
   return 0;
 }
 
 SEC("fentry/htab_map_delete_elem")
 int BPF_PROG(bpf_prog_kern_hmapdelete, struct bpf_map *map, void *key) {
-  bpf_printk("htab_map_delete_elem\n");
+  log_map_update(map, key, 0, MAP_DELETE);
+  return 0;
+}
+
+/* Fallback for kernels without BPF trampolines, on the same functions */
+SEC("kprobe/htab_map_update_elem")
+int BPF_KPROBE(bpf_prog_kprobe_hmapupdate, struct bpf_map *map, void *key,
+               void *value, u64 map_flags) {
+  log_map_update(map, key, value, MAP_UPDATE);
+  return 0;
+}
 
+SEC("kprobe/htab_map_delete_elem")
+int BPF_KPROBE(bpf_prog_kprobe_hmapdelete, struct bpf_map *map, void *key) {
   log_map_update(map, key, 0, MAP_DELETE);
   return 0;
 }
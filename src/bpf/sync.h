@@ -1,5 +1,12 @@
 #define BPF_NAME_LEN 16U
 #define MAX_EVENTS  (128)
+#define MAX_SYNCED_MAPS 64
+// Changes of maps with larger keys or values are not reported
+#define MAX_KEY_SIZE 64U
+#define MAX_VALUE_SIZE 256U
+// Filter rules applied in the kernel, per map
+#define MAX_FILTER_RULES 8
+#define MAX_FILTER_BYTES 16
 
 // Order matters!
 enum map_updater {
@@ -14,8 +21,31 @@ struct MapData {
     unsigned int pid;
     unsigned int key_size;
     unsigned int value_size;
-    unsigned int key;
-    unsigned int value;
+    unsigned char key[MAX_KEY_SIZE];
+    unsigned char value[MAX_VALUE_SIZE];
+};
+
+enum filter_action {
+    FILTER_ACTION_SEND,
+    FILTER_ACTION_SKIP
+};
+
+// Matches changes whose key, or value, has bytes equal to match once ANDed
+// with mask, from offset on. A rule comparing no bytes matches everything.
+struct FilterRule {
+    __u8 action;
+    __u8 in_value;
+    __u8 len;
+    __u8 _pad;
+    __u16 offset;
+    __u8 mask[MAX_FILTER_BYTES];
+    __u8 match[MAX_FILTER_BYTES];
+};
+
+// The first rule matching a change decides whether it's reported.
+struct Filter {
+    __u32 count;
+    struct FilterRule rules[MAX_FILTER_RULES];
 };
 
 struct Config {
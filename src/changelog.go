@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logSegmentPrefix = "changes-"
+	logSegmentSuffix = ".log"
+)
+
+// ChangeRecord is a single mutation, either made locally or received from a peer.
+// Keys and values are stored hex encoded in the map's native byte layout so
+// records can be replayed into the map as they are.
+type ChangeRecord struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"ts"`
+	Origin string    `json:"origin"`
+	Map    string    `json:"map"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`
+	Value  string    `json:"value,omitempty"`
+	// A local change the filters of the map kept from peers
+	Filtered bool `json:"filtered,omitempty"`
+}
+
+type ChangeLogOptions struct {
+	Dir             string
+	SegmentSize     int64         // Rotate once the active segment grows past this many bytes
+	RetentionSize   int64         // Remove the oldest segments once all of them exceed this many bytes, 0 keeps everything
+	RetentionMaxAge time.Duration // Remove segments whose newest record is older than this, 0 keeps everything
+}
+
+// ChangeLog is an append-only log of mutations split into segment files named
+// after the sequence number of their first record, so they sort in log order.
+//
+// It's an audit log, not a write-ahead log: a change is recorded once it's in
+// the map (local changes are only seen once the kernel made them), and
+// records reach the disk when the OS flushes them, or on rotation and Close.
+// A crash can lose the last records, and leave the last one torn.
+type ChangeLog struct {
+	mu     sync.Mutex
+	opts   ChangeLogOptions
+	seq    uint64
+	active *os.File
+	size   int64
+}
+
+func OpenChangeLog(opts ChangeLogOptions) (*ChangeLog, error) {
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	w := &ChangeLog{opts: opts}
+
+	segments, err := logSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		// Continue the sequence from the last record on disk. The last
+		// segment may be empty, in which case its name tells where it starts.
+		last := segments[len(segments)-1]
+		start, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(last), logSegmentPrefix), logSegmentSuffix), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad change log segment name %s: %w", last, err)
+		}
+		w.seq = start - 1
+		good, err := scanLogSegment(last, func(r ChangeRecord) error {
+			w.seq = r.Seq
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Cut off a torn record, new records may be appended to the segment.
+		if err := os.Truncate(last, good); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Append assigns the next sequence number and timestamp to r and writes it out.
+func (w *ChangeLog) Append(r ChangeRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	r.Seq = w.seq
+	r.Time = time.Now().UTC()
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if w.size > 0 && w.size+int64(len(line)) > w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.active.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// rotate closes the active segment, starts a new one and applies retention.
+func (w *ChangeLog) rotate() error {
+	if w.active != nil {
+		w.active.Sync()
+		w.active.Close()
+	}
+
+	name := filepath.Join(w.opts.Dir, fmt.Sprintf("%s%020d%s", logSegmentPrefix, w.seq+1, logSegmentSuffix))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.active, w.size = f, fi.Size()
+
+	return w.truncate()
+}
+
+// Truncate removes the oldest segments that fall outside the retention
+// policy. It's done on every rotation, call it periodically as well for the
+// age limit to apply on a quiet log.
+func (w *ChangeLog) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.truncate()
+}
+
+func (w *ChangeLog) truncate() error {
+	if w.opts.RetentionSize == 0 && w.opts.RetentionMaxAge == 0 {
+		return nil
+	}
+	segments, err := logSegments(w.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	infos := make([]os.FileInfo, len(segments))
+	for i, s := range segments {
+		fi, err := os.Stat(s)
+		if err != nil {
+			return err
+		}
+		infos[i] = fi
+		total += fi.Size()
+	}
+
+	for i, s := range segments {
+		if s == w.active.Name() {
+			break
+		}
+		// A segment is no longer written to once rotated, so its mtime is the time of its newest record.
+		tooOld := w.opts.RetentionMaxAge > 0 && time.Since(infos[i].ModTime()) > w.opts.RetentionMaxAge
+		tooBig := w.opts.RetentionSize > 0 && total > w.opts.RetentionSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.Remove(s); err != nil {
+			return err
+		}
+		total -= infos[i].Size()
+	}
+	return nil
+}
+
+func (w *ChangeLog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.active.Sync()
+	return w.active.Close()
+}
+
+// logSegments lists the segment files in dir in log order.
+func logSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), logSegmentPrefix) && strings.HasSuffix(e.Name(), logSegmentSuffix) {
+			segments = append(segments, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// readLogSegment calls fn for every record in the segment at path. A torn
+// record at the end of the segment, left by a crash, is skipped; a bad record
+// before the end is an error.
+func readLogSegment(path string, fn func(ChangeRecord) error) error {
+	_, err := scanLogSegment(path, fn)
+	return err
+}
+
+// scanLogSegment is readLogSegment, and also returns where the last good
+// record ends.
+func scanLogSegment(path string, fn func(ChangeRecord) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Whatever is left was never terminated: torn, or being written.
+			return good, nil
+		}
+		if err != nil {
+			return good, err
+		}
+		var rec ChangeRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+				// The last line, torn by a crash.
+				return good, nil
+			}
+			return good, fmt.Errorf("%s: corrupt record at line %d: %w", path, line, err)
+		}
+		if err := fn(rec); err != nil {
+			return good, err
+		}
+		good += int64(len(b))
+	}
+}
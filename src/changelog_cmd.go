@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// changelogCommand implements `map-sync changelog <tail|replay>`.
+func changelogCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: map-sync changelog <tail|replay> [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "tail":
+		changelogTail(args[1:])
+	case "replay":
+		changelogReplay(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown changelog command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func changelogTail(args []string) {
+	fs := flag.NewFlagSet("changelog tail", flag.ExitOnError)
+	dir := fs.String("dir", "", "Change log directory")
+	follow := fs.Bool("f", false, "Keep printing records as they are appended")
+	asJSON := fs.Bool("json", false, "Print records as JSON lines")
+	fs.Parse(args)
+
+	var last uint64
+	print := func(r ChangeRecord) error {
+		if r.Seq <= last {
+			return nil
+		}
+		last = r.Seq
+		if *asJSON {
+			line, _ := json.Marshal(r)
+			fmt.Println(string(line))
+			return nil
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\tkey=%s value=%s%s\n", r.Seq, r.Time.Format(time.RFC3339Nano), r.Origin, r.Map, r.Op, r.Key, r.Value, filteredMark(r.Filtered))
+		return nil
+	}
+
+	for {
+		segments, err := logSegments(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range segments {
+			if err := readLogSegment(s, print); err != nil && !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+		}
+		if !*follow {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func changelogReplay(args []string) {
+	fs := flag.NewFlagSet("changelog replay", flag.ExitOnError)
+	dir := fs.String("dir", "", "Change log directory")
+	mapName := fs.String("map", "", "Name of the map to rebuild, records of other maps are skipped")
+	target := fs.String("into", "", "Name of the loaded map to write to, defaults to -map")
+	untilSeq := fs.Uint64("until", 0, "Stop after this sequence number, 0 replays everything")
+	fs.Parse(args)
+
+	if *mapName == "" {
+		log.Fatal("-map is required")
+	}
+	if *target == "" {
+		*target = *mapName
+	}
+	m, err := findMapByName(*target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	segments, err := logSegments(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var applied int
+	for _, s := range segments {
+		err := readLogSegment(s, func(r ChangeRecord) error {
+			if *untilSeq != 0 && r.Seq > *untilSeq {
+				return nil
+			}
+			if r.Map != *mapName {
+				return nil
+			}
+			key, err := hex.DecodeString(r.Key)
+			if err != nil {
+				return fmt.Errorf("record %d: key: %w", r.Seq, err)
+			}
+			switch r.Op {
+			case UPDATE:
+				value, err := hex.DecodeString(r.Value)
+				if err != nil {
+					return fmt.Errorf("record %d: value: %w", r.Seq, err)
+				}
+				err = m.Update(key, value, ebpf.UpdateAny)
+				if err != nil {
+					return fmt.Errorf("record %d: %w", r.Seq, err)
+				}
+			case DELETE:
+				err := m.Delete(key)
+				if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+					return fmt.Errorf("record %d: %w", r.Seq, err)
+				}
+			}
+			applied++
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Replayed %d records into %s", applied, *target)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadLogSegment(t *testing.T) {
+	const (
+		rec1 = `{"seq":1,"origin":"a","map":"m","op":"UPDATE","key":"01","value":"02"}` + "\n"
+		rec2 = `{"seq":2,"origin":"a","map":"m","op":"DELETE","key":"01"}` + "\n"
+	)
+	tests := []struct {
+		name    string
+		data    string
+		want    []uint64
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "records", data: rec1 + rec2, want: []uint64{1, 2}},
+		{name: "unterminated tail", data: rec1 + `{"seq":2,"ori`, want: []uint64{1}},
+		{name: "torn last line", data: rec1 + "{\"seq\":2,\"ori\n", want: []uint64{1}},
+		{name: "corrupt middle", data: rec1 + "garbage\n" + rec2, want: []uint64{1}, wantErr: true},
+		{name: "corrupt first", data: "\x00\x00\n" + rec1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "changes-00000000000000000001.log")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var got []uint64
+			err := readLogSegment(path, func(r ChangeRecord) error {
+				got = append(got, r.Seq)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("read records %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("read records %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeLogReopenAfterTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenChangeLog(ChangeLogOptions{Dir: dir, SegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(ChangeRecord{Origin: "a", Map: "m", Op: "UPDATE", Key: "01", Value: "02"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	segments, err := logSegments(dir)
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("segments %v, error %v", segments, err)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"ori`)
+	f.Close()
+
+	l, err = OpenChangeLog(ChangeLogOptions{Dir: dir, SegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("reopening after a torn tail: %v", err)
+	}
+	if err := l.Append(ChangeRecord{Origin: "a", Map: "m", Op: "DELETE", Key: "01"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	var ops []string
+	segments, _ = logSegments(dir)
+	for _, s := range segments {
+		err := readLogSegment(s, func(r ChangeRecord) error {
+			ops = append(ops, r.Op)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("reading %s: %v", s, err)
+		}
+	}
+	if got := strings.Join(ops, ","); got != "UPDATE,DELETE" {
+		t.Errorf("read %s, want UPDATE,DELETE", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"expvar"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/stats"
+)
+
+// Compressors registered with gRPC, which peers can agree on. Each one is
+// announced as a capability, e.g. "compression/gzip".
+var compressors = []string{gzip.Name}
+
+const CAP_COMPRESSION_PREFIX = "compression/"
+
+func init() {
+	for _, c := range compressors {
+		capabilities = append(capabilities, CAP_COMPRESSION_PREFIX+c)
+	}
+}
+
+// compressionCapability returns the capability announcing compressor, or ""
+// for no compression.
+func compressionCapability(compressor string) string {
+	if compressor == "" || compressor == "none" {
+		return ""
+	}
+	return CAP_COMPRESSION_PREFIX + compressor
+}
+
+// payloadStats counts the bytes of the messages of a connection before and
+// after compression, under name in the payload_bytes and compressed_bytes
+// metrics.
+type payloadStats struct {
+	name string
+}
+
+func newPayloadStats(name string) *payloadStats {
+	compressionRatio.Set(name, expvar.Func(func() any {
+		compressed := compressedBytes.Get(name)
+		if compressed == nil || compressed.(*expvar.Int).Value() == 0 {
+			return 1.0
+		}
+		return float64(payloadBytes.Get(name).(*expvar.Int).Value()) / float64(compressed.(*expvar.Int).Value())
+	}))
+	return &payloadStats{name: name}
+}
+
+func (s *payloadStats) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	var length, compressed int
+	switch p := rs.(type) {
+	case *stats.OutPayload:
+		length, compressed = p.Length, p.CompressedLength
+	case *stats.InPayload:
+		length, compressed = p.Length, p.CompressedLength
+	default:
+		return
+	}
+	payloadBytes.Add(s.name, int64(length))
+	compressedBytes.Add(s.name, int64(compressed))
+}
+
+func (s *payloadStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (s *payloadStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (s *payloadStats) HandleConn(context.Context, stats.ConnStats) {}
+
+// compressorOption returns the call option compressing with compressor, if any.
+func compressorOption(compressor string) []grpc.CallOption {
+	if compressor == "" || compressor == "none" {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(compressor)}
+}
@@ -0,0 +1,920 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a node. It's read from the YAML file given with -config
+// and any setting can then be overridden with a flag.
+type Config struct {
+	Node      NodeConfig        `yaml:"node"`
+	Listen    string            `yaml:"listen"`
+	Metrics   string            `yaml:"metrics"`
+	Attach    string            `yaml:"attach"`
+	Peers     []PeerConfig      `yaml:"peers"`
+	Maps      []MapConfig       `yaml:"maps"`
+	Pins      PinsConfig        `yaml:"pins"`
+	Gossip    GossipConfig      `yaml:"gossip"`
+	Raft      RaftConfig        `yaml:"raft"`
+	Discovery []DiscoveryConfig `yaml:"discovery"`
+	TLS       TLSConfig         `yaml:"tls"`
+	Logging   LoggingConfig     `yaml:"logging"`
+	Queue     QueueConfig       `yaml:"queue"`
+	Batch     BatchConfig       `yaml:"batch"`
+	ChangeLog ChangeLogConfig   `yaml:"changelog"`
+}
+
+// How the programs reporting changes of hash maps are attached to the kernel.
+const (
+	ATTACH_AUTO   = "auto"   // fentry if the kernel supports it, kprobes otherwise
+	ATTACH_FENTRY = "fentry" // BPF trampolines, needing BTF and, on arm64, a recent kernel
+	ATTACH_KPROBE = "kprobe" // Slower, but available on any kernel
+)
+
+type NodeConfig struct {
+	Name string `yaml:"name"`
+}
+
+type PeerConfig struct {
+	Address string `yaml:"address"`
+	// Compressor of the changes sent to the peer, used if the peer supports
+	// it too. Empty or "none" disables compression.
+	Compression string `yaml:"compression"`
+}
+
+// Replication directions of a map.
+const (
+	REPLICATE_BOTH    = "both"    // Send local changes and apply changes from peers
+	REPLICATE_SEND    = "send"    // Only send local changes
+	REPLICATE_RECEIVE = "receive" // Only apply changes from peers
+	REPLICATE_RAFT    = "raft"    // Commit changes through the Raft log before applying them everywhere
+)
+
+// What a node does with a local change of a key another node owns, in maps
+// with ownership.
+const (
+	OWNERSHIP_FORWARD = "forward" // Send it to the owner, which applies it and sends it to everyone
+	OWNERSHIP_REJECT  = "reject"  // Set the key back to the owner's value
+)
+
+// What nodes do with the entries a member sent once it's declared dead, in
+// maps tracking their origin.
+const (
+	DEAD_ORIGIN_KEEP     = "keep"     // Leave them, the default
+	DEAD_ORIGIN_PURGE    = "purge"    // Delete them
+	DEAD_ORIGIN_REASSIGN = "reassign" // Make the owner of each key among the live members its origin
+)
+
+// MapConfig names a map to synchronize. Maps created by other loaders are
+// opened from their bpffs Pin, and checked against the Type, KeySize and
+// ValueSize given here, if any.
+type MapConfig struct {
+	Name      string `yaml:"name"`
+	Replicate string `yaml:"replicate"`
+	Pin       string `yaml:"pin"`
+	Type      string `yaml:"type"`
+	KeySize   uint32 `yaml:"key_size"`
+	ValueSize uint32 `yaml:"value_size"`
+	// Gives every key an owner among the members of the cluster, the only
+	// node whose changes of it are sent to peers. Empty if any node may
+	// change any key.
+	Ownership string `yaml:"ownership"`
+	// Decide which local changes are sent to peers.
+	Filters []FilterRule `yaml:"filters"`
+	// Also apply Filters in the kernel, so skipped changes don't even reach
+	// userspace.
+	KernelFilters bool `yaml:"kernel_filters"`
+	// Rewrite changes from peers before they're applied, in order.
+	Transforms []TransformConfig `yaml:"transforms"`
+	// Entries from peers are deleted if their origin doesn't send them again
+	// within TTL, e.g. because its delete was lost, and the node's own entries
+	// are sent again every TTL/2 to keep them alive. Zero keeps them.
+	TTL time.Duration `yaml:"ttl"`
+	// What happens to the entries from a member once gossip declares it dead.
+	DeadOrigin string `yaml:"dead_origin"`
+}
+
+// Actions of filter rules.
+const (
+	FILTER_SEND = "send" // Send matching changes to peers
+	FILTER_SKIP = "skip" // Keep matching changes local
+)
+
+// FilterRule matches local changes of a map by their key or value: a field
+// named after the map's BTF, or the bytes at an offset. The first rule
+// matching a change decides whether it's sent to peers; changes no rule
+// matches are sent.
+type FilterRule struct {
+	Action string `yaml:"action"`
+	In     string `yaml:"in"` // key or value, key if empty
+	// A field, e.g. tuple.saddr, equal to a number or within an IP prefix.
+	Field  string `yaml:"field"`
+	Equals string `yaml:"equals"`
+	// Or the bytes at Offset, ANDed with Mask, equal to Match, both in hex.
+	// Mask defaults to all ones. A rule with neither matches every change.
+	Offset uint32 `yaml:"offset"`
+	Match  string `yaml:"match"`
+	Mask   string `yaml:"mask"`
+}
+
+// Local changes of raft maps are reported by the kernel like those of maps
+// sent to peers, but are proposed to the Raft log instead.
+func (m MapConfig) sends() bool    { return m.Replicate != REPLICATE_RECEIVE }
+func (m MapConfig) receives() bool { return m.Replicate != REPLICATE_SEND && !m.raft() }
+func (m MapConfig) raft() bool     { return m.Replicate == REPLICATE_RAFT }
+func (m MapConfig) owned() bool    { return m.Ownership != "" }
+
+// tracksOrigins reports whether the origin of every entry from a peer is
+// tracked, for it to expire or be cleaned up after its origin dies.
+func (m MapConfig) tracksOrigins() bool {
+	return m.TTL > 0 || m.DeadOrigin != "" && m.DeadOrigin != DEAD_ORIGIN_KEEP
+}
+
+type PinsConfig struct {
+	// How often pinned maps are checked for being recreated by their loader.
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// GossipConfig makes the node a member of a cluster, joined through any of
+// the Seeds. Changes are then sent to every live member, besides the
+// configured peers.
+type GossipConfig struct {
+	Advertise        string        `yaml:"advertise"` // Address members reach this node at, gossip is disabled if empty
+	Seeds            []string      `yaml:"seeds"`
+	Interval         time.Duration `yaml:"interval"`          // Between probes of a member
+	ProbeTimeout     time.Duration `yaml:"probe_timeout"`     // For a member to answer a probe
+	IndirectProbes   int           `yaml:"indirect_probes"`   // Members asked to probe a member that didn't answer
+	SuspicionTimeout time.Duration `yaml:"suspicion_timeout"` // For a suspected member to refute it before it's declared dead
+}
+
+func (g GossipConfig) enabled() bool { return g.Advertise != "" }
+
+// RaftConfig makes the node a member of the Raft cluster committing the
+// changes of raft maps. Members lists every member, this node included.
+type RaftConfig struct {
+	Dir               string        `yaml:"dir"` // Where the log, the vote and snapshots are kept
+	Members           []RaftMember  `yaml:"members"`
+	ElectionTimeout   time.Duration `yaml:"election_timeout"`   // Without hearing from a leader before becoming a candidate, randomized up to twice as long
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"` // Between messages from the leader
+	SnapshotThreshold int           `yaml:"snapshot_threshold"` // Applied entries kept in the log before compacting it into a snapshot
+}
+
+type RaftMember struct {
+	Name    string `yaml:"name"` // The member's node.name
+	Address string `yaml:"address"`
+}
+
+func (r RaftConfig) enabled() bool { return len(r.Members) > 0 }
+
+// Discovery backends built in, see discovery.go.
+const (
+	DISCOVERY_FILE       = "file"       // Addresses listed in a file
+	DISCOVERY_DNS        = "dns"        // SRV, or A and AAAA records
+	DISCOVERY_KUBERNETES = "kubernetes" // Endpoints of a service
+)
+
+// DiscoveryConfig configures a source of peers. Which fields are used
+// depends on the Type.
+type DiscoveryConfig struct {
+	Type     string        `yaml:"type"`
+	Interval time.Duration `yaml:"interval"` // How often the source is checked for changes, files only if they can't be watched
+	// file
+	Path string `yaml:"path"`
+	// dns: SRV records of Name, or its A and AAAA records with Port.
+	Name string `yaml:"name"`
+	Port string `yaml:"port"` // kubernetes: the name or number of the service port, the first one if empty
+	// kubernetes: the in-cluster API server and service account are used
+	// unless APIServer is set.
+	Namespace string `yaml:"namespace"`
+	Service   string `yaml:"service"`
+	APIServer string `yaml:"api_server"`
+	TokenFile string `yaml:"token_file"`
+	CAFile    string `yaml:"ca_file"`
+}
+
+// TLSConfig secures both the server and the connections to peers. Setting CA
+// makes the server require client certificates signed by it.
+type TLSConfig struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	CA         string `yaml:"ca"`
+	ServerName string `yaml:"server_name"`
+}
+
+func (t TLSConfig) enabled() bool { return t.Cert != "" || t.CA != "" }
+
+type LoggingConfig struct {
+	Level           string            `yaml:"level"`
+	Format          string            `yaml:"format"`            // text (logfmt) or json
+	Subsystems      map[string]string `yaml:"subsystems"`        // Level by subsystem, overriding Level
+	SamplePerSecond int               `yaml:"sample_per_second"` // Log at most this many records per map each second, 0 logs everything
+}
+
+type QueueConfig struct {
+	Size int    `yaml:"size"`
+	Dir  string `yaml:"dir"`
+}
+
+// BatchConfig controls how local changes are sent. For Window after a change,
+// further changes are collected and repeated writes to a key coalesced to the
+// last one, unless MaxSize changes are pending first. Changes are sent to
+// peers in batches of up to MaxSize.
+type BatchConfig struct {
+	Window  time.Duration `yaml:"window"`
+	MaxSize int           `yaml:"max_size"`
+}
+
+type ChangeLogConfig struct {
+	Dir             string        `yaml:"dir"`
+	SegmentSize     int64         `yaml:"segment_size"`
+	RetentionSize   int64         `yaml:"retention_size"`
+	RetentionMaxAge time.Duration `yaml:"retention_age"`
+}
+
+const defaultDiscoveryInterval = 10 * time.Second
+
+func defaultConfig() Config {
+	hostname, _ := os.Hostname()
+	return Config{
+		Node:      NodeConfig{Name: hostname},
+		Listen:    ":50051",
+		Attach:    ATTACH_AUTO,
+		Maps:      []MapConfig{{Name: "hash_map"}},
+		Pins:      PinsConfig{CheckInterval: 5 * time.Second},
+		Raft:      RaftConfig{ElectionTimeout: time.Second, HeartbeatInterval: 100 * time.Millisecond, SnapshotThreshold: 10000},
+		Gossip:    GossipConfig{Interval: time.Second, ProbeTimeout: 500 * time.Millisecond, IndirectProbes: 3, SuspicionTimeout: 5 * time.Second},
+		Logging:   LoggingConfig{Level: "info"},
+		Queue:     QueueConfig{Size: 10000},
+		Batch:     BatchConfig{MaxSize: 500},
+		ChangeLog: ChangeLogConfig{SegmentSize: 64 << 20},
+	}
+}
+
+// setDefaults fills in the defaults of the entries of lists, which
+// defaultConfig can't hold. It's done before validating.
+func (c *Config) setDefaults() {
+	for i := range c.Discovery {
+		if c.Discovery[i].Interval == 0 {
+			c.Discovery[i].Interval = defaultDiscoveryInterval
+		}
+	}
+}
+
+// loadConfig reads the config file at path on top of the defaults.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			if n := lookupYAML(&root, fe.path); n != nil {
+				return cfg, fmt.Errorf("%s:%d: %w", path, n.Line, err)
+			}
+		}
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// fieldError is a validation error of the setting at path, e.g. "peers[1].address".
+type fieldError struct {
+	path string
+	msg  string
+}
+
+func (e *fieldError) Error() string {
+	return e.path + ": " + e.msg
+}
+
+func fieldErrorf(path, format string, args ...any) error {
+	return &fieldError{path: path, msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *Config) validate() error {
+	if c.Node.Name == "" {
+		return fieldErrorf("node.name", "must not be empty")
+	}
+	if _, err := c.listenPort(); err != nil {
+		return fieldErrorf("listen", "%v", err)
+	}
+	if c.Metrics != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics); err != nil {
+			return fieldErrorf("metrics", "%v", err)
+		}
+	}
+	switch c.Attach {
+	case "", ATTACH_AUTO, ATTACH_FENTRY, ATTACH_KPROBE:
+	default:
+		return fieldErrorf("attach", "must be one of %s, %s or %s", ATTACH_AUTO, ATTACH_FENTRY, ATTACH_KPROBE)
+	}
+
+	seen := make(map[string]bool)
+	for i, p := range c.Peers {
+		field := fmt.Sprintf("peers[%d].address", i)
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fieldErrorf(field, "%v", err)
+		}
+		if seen[p.Address] {
+			return fieldErrorf(field, "duplicate peer %s", p.Address)
+		}
+		seen[p.Address] = true
+		if p.Compression != "" && p.Compression != "none" && !slices.Contains(compressors, p.Compression) {
+			return fieldErrorf(fmt.Sprintf("peers[%d].compression", i), "must be none or one of %s", strings.Join(compressors, ", "))
+		}
+	}
+
+	if len(c.Maps) == 0 {
+		return fieldErrorf("maps", "at least one map must be synchronized")
+	}
+	seen = make(map[string]bool)
+	for i, m := range c.Maps {
+		field := fmt.Sprintf("maps[%d]", i)
+		if m.Name == "" {
+			return fieldErrorf(field+".name", "must not be empty")
+		}
+		if seen[m.Name] {
+			return fieldErrorf(field+".name", "duplicate map %s", m.Name)
+		}
+		seen[m.Name] = true
+		switch m.Replicate {
+		case "", REPLICATE_BOTH, REPLICATE_SEND, REPLICATE_RECEIVE:
+		case REPLICATE_RAFT:
+			if !c.Raft.enabled() {
+				return fieldErrorf(field+".replicate", "raft.members must be set to replicate a map through raft")
+			}
+		default:
+			return fieldErrorf(field+".replicate", "must be one of %s, %s, %s or %s", REPLICATE_BOTH, REPLICATE_SEND, REPLICATE_RECEIVE, REPLICATE_RAFT)
+		}
+		switch m.Ownership {
+		case "":
+		case OWNERSHIP_FORWARD, OWNERSHIP_REJECT:
+			if m.Replicate != "" && m.Replicate != REPLICATE_BOTH {
+				return fieldErrorf(field+".ownership", "requires replicate: %s", REPLICATE_BOTH)
+			}
+			if !c.Gossip.enabled() {
+				return fieldErrorf(field+".ownership", "keys are owned by members of the cluster, gossip.advertise must be set")
+			}
+		default:
+			return fieldErrorf(field+".ownership", "must be %s or %s", OWNERSHIP_FORWARD, OWNERSHIP_REJECT)
+		}
+		if len(m.Filters) > 0 && m.raft() {
+			return fieldErrorf(field+".filters", "raft maps must hold the same keys on every member")
+		}
+		for j, r := range m.Filters {
+			if err := r.validate(); err != nil {
+				return fieldErrorf(fmt.Sprintf("%s.filters[%d]", field, j), "%v", err)
+			}
+		}
+		if m.TTL < 0 {
+			return fieldErrorf(field+".ttl", "must not be negative")
+		}
+		if m.TTL > 0 && m.raft() {
+			return fieldErrorf(field+".ttl", "raft maps must hold the same keys on every member")
+		}
+		if m.TTL > 0 && m.Ownership == OWNERSHIP_FORWARD {
+			// Neither the writer, which doesn't own the key, nor the owner,
+			// which got it from a peer, would send a forwarded entry again.
+			return fieldErrorf(field+".ttl", "forwarded entries would expire, not with ownership: %s", OWNERSHIP_FORWARD)
+		}
+		switch m.DeadOrigin {
+		case "", DEAD_ORIGIN_KEEP:
+		case DEAD_ORIGIN_PURGE, DEAD_ORIGIN_REASSIGN:
+			if !m.receives() {
+				return fieldErrorf(field+".dead_origin", "only entries from peers have another origin, and the map doesn't apply any")
+			}
+			if !c.Gossip.enabled() {
+				return fieldErrorf(field+".dead_origin", "members are declared dead by gossip, gossip.advertise must be set")
+			}
+		default:
+			return fieldErrorf(field+".dead_origin", "must be one of %s, %s or %s", DEAD_ORIGIN_KEEP, DEAD_ORIGIN_PURGE, DEAD_ORIGIN_REASSIGN)
+		}
+		if len(m.Transforms) > 0 && !m.receives() {
+			return fieldErrorf(field+".transforms", "only changes from peers are transformed, and the map doesn't apply any")
+		}
+		for j, t := range m.Transforms {
+			if err := t.validate(); err != nil {
+				return fieldErrorf(fmt.Sprintf("%s.transforms[%d]", field, j), "%v", err)
+			}
+		}
+		if m.KernelFilters && len(m.Filters) > MAX_FILTER_RULES {
+			return fieldErrorf(field+".kernel_filters", "at most %d filters can be applied in the kernel", MAX_FILTER_RULES)
+		}
+		if m.Pin == "" && m.Name != ownMapName {
+			return fieldErrorf(field+".pin", "must be set for maps not loaded by map-sync")
+		}
+		if m.KeySize > MAX_KEY_SIZE {
+			return fieldErrorf(field+".key_size", "must be at most %d", MAX_KEY_SIZE)
+		}
+		if m.ValueSize > MAX_VALUE_SIZE {
+			return fieldErrorf(field+".value_size", "must be at most %d", MAX_VALUE_SIZE)
+		}
+	}
+	if c.Pins.CheckInterval <= 0 {
+		return fieldErrorf("pins.check_interval", "must be positive")
+	}
+
+	if c.Raft.enabled() {
+		if c.Raft.Dir == "" {
+			return fieldErrorf("raft.dir", "must be set")
+		}
+		seen = make(map[string]bool)
+		for i, m := range c.Raft.Members {
+			field := fmt.Sprintf("raft.members[%d]", i)
+			if m.Name == "" {
+				return fieldErrorf(field+".name", "must not be empty")
+			}
+			if seen[m.Name] {
+				return fieldErrorf(field+".name", "duplicate member %s", m.Name)
+			}
+			seen[m.Name] = true
+			if _, _, err := net.SplitHostPort(m.Address); err != nil {
+				return fieldErrorf(field+".address", "%v", err)
+			}
+		}
+		if !seen[c.Node.Name] {
+			return fieldErrorf("raft.members", "must include this node, %s", c.Node.Name)
+		}
+	}
+	if c.Raft.ElectionTimeout <= 0 {
+		return fieldErrorf("raft.election_timeout", "must be positive")
+	}
+	if c.Raft.HeartbeatInterval <= 0 || c.Raft.HeartbeatInterval >= c.Raft.ElectionTimeout {
+		return fieldErrorf("raft.heartbeat_interval", "must be positive and shorter than raft.election_timeout")
+	}
+	if c.Raft.SnapshotThreshold <= 0 {
+		return fieldErrorf("raft.snapshot_threshold", "must be positive")
+	}
+
+	if c.Gossip.Advertise != "" {
+		if _, _, err := net.SplitHostPort(c.Gossip.Advertise); err != nil {
+			return fieldErrorf("gossip.advertise", "%v", err)
+		}
+	} else if len(c.Gossip.Seeds) > 0 {
+		return fieldErrorf("gossip.advertise", "must be set to join through seeds")
+	}
+	for i, s := range c.Gossip.Seeds {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return fieldErrorf(fmt.Sprintf("gossip.seeds[%d]", i), "%v", err)
+		}
+	}
+	for i, d := range c.Discovery {
+		field := fmt.Sprintf("discovery[%d]", i)
+		if _, ok := discoveryBackends[d.Type]; !ok {
+			types := make([]string, 0, len(discoveryBackends))
+			for t := range discoveryBackends {
+				types = append(types, t)
+			}
+			slices.Sort(types)
+			return fieldErrorf(field+".type", "must be one of %s", strings.Join(types, ", "))
+		}
+		if d.Interval < 0 {
+			return fieldErrorf(field+".interval", "must be positive")
+		}
+	}
+
+	if c.Gossip.Interval <= 0 {
+		return fieldErrorf("gossip.interval", "must be positive")
+	}
+	if c.Gossip.ProbeTimeout <= 0 || c.Gossip.ProbeTimeout > c.Gossip.Interval {
+		return fieldErrorf("gossip.probe_timeout", "must be positive and at most gossip.interval")
+	}
+	if c.Gossip.IndirectProbes < 0 {
+		return fieldErrorf("gossip.indirect_probes", "must not be negative")
+	}
+	if c.Gossip.SuspicionTimeout <= 0 {
+		return fieldErrorf("gossip.suspicion_timeout", "must be positive")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fieldErrorf("tls.cert", "tls.cert and tls.key must be set together")
+	}
+	if _, err := parseLevel(c.Logging.Level); err != nil {
+		return fieldErrorf("logging.level", "must be debug, info, warn or error")
+	}
+	switch c.Logging.Format {
+	case "", "text", "logfmt", "json":
+	default:
+		return fieldErrorf("logging.format", "must be text, logfmt or json")
+	}
+	for name, level := range c.Logging.Subsystems {
+		if !slices.Contains(subsystems, name) {
+			return fieldErrorf("logging.subsystems."+name, "unknown subsystem, must be one of %s", strings.Join(subsystems, ", "))
+		}
+		if _, err := parseLevel(level); err != nil {
+			return fieldErrorf("logging.subsystems."+name, "must be debug, info, warn or error")
+		}
+	}
+	if c.Logging.SamplePerSecond < 0 {
+		return fieldErrorf("logging.sample_per_second", "must not be negative")
+	}
+	if c.Queue.Size <= 0 {
+		return fieldErrorf("queue.size", "must be positive")
+	}
+	if c.Batch.Window < 0 {
+		return fieldErrorf("batch.window", "must not be negative")
+	}
+	if c.Batch.MaxSize <= 0 {
+		return fieldErrorf("batch.max_size", "must be positive")
+	}
+	if c.ChangeLog.SegmentSize <= 0 {
+		return fieldErrorf("changelog.segment_size", "must be positive")
+	}
+	if c.ChangeLog.RetentionSize < 0 {
+		return fieldErrorf("changelog.retention_size", "must not be negative")
+	}
+	if c.ChangeLog.RetentionMaxAge < 0 {
+		return fieldErrorf("changelog.retention_age", "must not be negative")
+	}
+	return nil
+}
+
+func (r FilterRule) validate() error {
+	switch r.Action {
+	case FILTER_SEND, FILTER_SKIP:
+	default:
+		return fmt.Errorf("action must be %s or %s", FILTER_SEND, FILTER_SKIP)
+	}
+	switch r.In {
+	case "", "key", "value":
+	default:
+		return fmt.Errorf("in must be key or value")
+	}
+	if r.Field != "" && (r.Match != "" || r.Mask != "") {
+		return fmt.Errorf("a field and bytes can't be matched by the same rule")
+	}
+	if (r.Field == "") != (r.Equals == "") {
+		return fmt.Errorf("field and equals must be set together")
+	}
+	match, err := hex.DecodeString(r.Match)
+	if err != nil {
+		return fmt.Errorf("match: %v", err)
+	}
+	mask, err := hex.DecodeString(r.Mask)
+	if err != nil {
+		return fmt.Errorf("mask: %v", err)
+	}
+	if r.Mask != "" && len(mask) != len(match) {
+		return fmt.Errorf("mask and match must be as long")
+	}
+	return nil
+}
+
+// Built-in transforms, see transform.go.
+const (
+	TRANSFORM_SET  = "set"  // Set the field to Value
+	TRANSFORM_ZERO = "zero" // Set the field to zero
+	TRANSFORM_KEEP = "keep" // Keep the field of the local entry, zero if there's none
+)
+
+// TransformConfig rewrites changes of a map from peers before they're applied.
+// Built-in transforms rewrite a field named after the map's BTF, the others
+// are registered with registerTransform and read their Options.
+type TransformConfig struct {
+	Type    string            `yaml:"type"`
+	In      string            `yaml:"in"` // key or value, value if empty
+	Field   string            `yaml:"field"`
+	Value   string            `yaml:"value"` // set: a number or an IP address
+	Options map[string]string `yaml:"options"`
+}
+
+func (t TransformConfig) validate() error {
+	if _, ok := transformTypes[t.Type]; !ok {
+		return fmt.Errorf("unknown transform type %q", t.Type)
+	}
+	switch t.In {
+	case "", "key", "value":
+	default:
+		return fmt.Errorf("in must be key or value")
+	}
+	switch t.Type {
+	case TRANSFORM_SET, TRANSFORM_ZERO, TRANSFORM_KEEP:
+		if t.Field == "" {
+			return fmt.Errorf("field must be set")
+		}
+		if (t.Type == TRANSFORM_SET) != (t.Value != "") {
+			return fmt.Errorf("value must be set for, and only for, %s", TRANSFORM_SET)
+		}
+		if t.Type == TRANSFORM_KEEP && t.In == "key" {
+			return fmt.Errorf("only fields of the value can be kept")
+		}
+	}
+	return nil
+}
+
+// listenPort returns the port the server listens on.
+func (c *Config) listenPort() (uint16, error) {
+	_, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad port %q", port)
+	}
+	return uint16(p), nil
+}
+
+func (c *Config) mapConfig(name string) (MapConfig, bool) {
+	for _, m := range c.Maps {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return MapConfig{}, false
+}
+
+// parseDiscovery parses the value of -discover.
+func parseDiscovery(v string) (DiscoveryConfig, error) {
+	typ, arg, _ := strings.Cut(v, ":")
+	d := DiscoveryConfig{Type: typ}
+	switch typ {
+	case DISCOVERY_FILE:
+		d.Path = arg
+	case DISCOVERY_DNS:
+		d.Name = arg
+		if name, port, err := net.SplitHostPort(arg); err == nil {
+			d.Name, d.Port = name, port
+		}
+	case DISCOVERY_KUBERNETES:
+		svc, port, _ := strings.Cut(arg, ":")
+		if ns, name, ok := strings.Cut(svc, "/"); ok {
+			d.Namespace, svc = ns, name
+		}
+		d.Service, d.Port = svc, port
+	default:
+		// Backends added with registerDiscovery are only configured in the file.
+		return d, fmt.Errorf("unknown discovery type %q", typ)
+	}
+	return d, nil
+}
+
+// lookupYAML returns the node of the setting at path, such as "peers[1].address".
+func lookupYAML(root *yaml.Node, path string) *yaml.Node {
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, part := range strings.Split(path, ".") {
+		name, index, hasIndex := strings.Cut(part, "[")
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == name {
+				next = n.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+		if hasIndex {
+			i, err := strconv.Atoi(strings.TrimSuffix(index, "]"))
+			if err != nil || n.Kind != yaml.SequenceNode || i >= len(n.Content) {
+				return n
+			}
+			n = n.Content[i]
+		}
+	}
+	return n
+}
+
+// configFlags registers a flag for every setting on fs. The returned function
+// applies the flags that were set on top of a config read from a file.
+func configFlags(fs *flag.FlagSet) func(*Config) error {
+	var overrides []func(*Config) error
+	set := func(name, usage string, apply func(c *Config, v string) error) {
+		fs.Func(name, usage, func(v string) error {
+			overrides = append(overrides, func(c *Config) error {
+				if err := apply(c, v); err != nil {
+					return fmt.Errorf("-%s: %w", name, err)
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	str := func(name, usage string, field func(c *Config) *string) {
+		set(name, usage, func(c *Config, v string) error {
+			*field(c) = v
+			return nil
+		})
+	}
+	num := func(name, usage string, field func(c *Config) *int64) {
+		set(name, usage, func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 0, 64)
+			*field(c) = n
+			return err
+		})
+	}
+
+	str("node", "Name of this node, recorded as the origin of its changes (default: hostname)", func(c *Config) *string { return &c.Node.Name })
+	str("listen", "Address to listen for peers on (default :50051)", func(c *Config) *string { return &c.Listen })
+	set("port", "Current host listen port, shorthand for -listen :<port>", func(c *Config, v string) error {
+		c.Listen = ":" + v
+		return nil
+	})
+	str("metrics", "Address to serve metrics on (e.g. :9090), disabled if empty", func(c *Config) *string { return &c.Metrics })
+	str("attach", "How to attach to hash map changes: auto, fentry or kprobe (default auto)", func(c *Config) *string { return &c.Attach })
+
+	// -peer and -map replace the lists from the config file on first use and append afterwards.
+	var peersSet, mapsSet, seedsSet, discoverySet, raftMembersSet bool
+	set("peer", "Address of a peer to sync to, can be repeated", func(c *Config, v string) error {
+		if !peersSet {
+			c.Peers, peersSet = nil, true
+		}
+		c.Peers = append(c.Peers, PeerConfig{Address: v})
+		return nil
+	})
+	set("map", "Name of a map to sync, or name=path of a map pinned by another loader, can be repeated", func(c *Config, v string) error {
+		if !mapsSet {
+			c.Maps, mapsSet = nil, true
+		}
+		name, pin, _ := strings.Cut(v, "=")
+		c.Maps = append(c.Maps, MapConfig{Name: name, Pin: pin})
+		return nil
+	})
+	set("pin-check-interval", "How often pinned maps are checked for being recreated by their loader (default 5s)", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Pins.CheckInterval = d
+		return err
+	})
+
+	set("discover", "Source of peers: file:<path>, dns:<SRV name>, dns:<name>:<port> or kubernetes:[<namespace>/]<service>[:<port>], can be repeated", func(c *Config, v string) error {
+		if !discoverySet {
+			c.Discovery, discoverySet = nil, true
+		}
+		d, err := parseDiscovery(v)
+		c.Discovery = append(c.Discovery, d)
+		return err
+	})
+	str("advertise", "Address other members reach this node at, enables gossip", func(c *Config) *string { return &c.Gossip.Advertise })
+	set("seed", "Address of a member to join the cluster through, can be repeated", func(c *Config, v string) error {
+		if !seedsSet {
+			c.Gossip.Seeds, seedsSet = nil, true
+		}
+		c.Gossip.Seeds = append(c.Gossip.Seeds, v)
+		return nil
+	})
+	set("gossip-interval", "How often a member is probed (default 1s)", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Gossip.Interval = d
+		return err
+	})
+	set("gossip-probe-timeout", "How long a member has to answer a probe (default 500ms)", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Gossip.ProbeTimeout = d
+		return err
+	})
+	set("gossip-indirect-probes", "How many members probe a member that didn't answer (default 3)", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Gossip.IndirectProbes = n
+		return err
+	})
+	set("gossip-suspicion-timeout", "How long a suspected member has to refute it before it's declared dead (default 5s)", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Gossip.SuspicionTimeout = d
+		return err
+	})
+
+	str("raft-dir", "Directory to keep the Raft log in", func(c *Config) *string { return &c.Raft.Dir })
+	set("raft-member", "Member of the Raft cluster as name=address, this node included, can be repeated", func(c *Config, v string) error {
+		if !raftMembersSet {
+			c.Raft.Members, raftMembersSet = nil, true
+		}
+		name, addr, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected <name>=<address>")
+		}
+		c.Raft.Members = append(c.Raft.Members, RaftMember{Name: name, Address: addr})
+		return nil
+	})
+	set("raft-election-timeout", "How long without a leader before holding an election (default 1s)", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Raft.ElectionTimeout = d
+		return err
+	})
+	set("raft-heartbeat-interval", "How often the leader contacts the other members (default 100ms)", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Raft.HeartbeatInterval = d
+		return err
+	})
+	set("raft-snapshot-threshold", "Applied entries kept in the Raft log before compacting it (default 10000)", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Raft.SnapshotThreshold = n
+		return err
+	})
+
+	str("tls-cert", "TLS certificate of this node", func(c *Config) *string { return &c.TLS.Cert })
+	str("tls-key", "TLS key of this node", func(c *Config) *string { return &c.TLS.Key })
+	str("tls-ca", "CA that signs the certificates of peers", func(c *Config) *string { return &c.TLS.CA })
+	str("tls-server-name", "Name to verify peer certificates against, instead of the address", func(c *Config) *string { return &c.TLS.ServerName })
+	str("log-level", "Log level, debug, info, warn or error (default info)", func(c *Config) *string { return &c.Logging.Level })
+	str("log-format", "Log format, text (logfmt) or json", func(c *Config) *string { return &c.Logging.Format })
+	set("log-subsystem", "Log level of a subsystem as <subsystem>=<level>, can be repeated. Subsystems are "+strings.Join(subsystems, ", "), func(c *Config, v string) error {
+		name, level, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected <subsystem>=<level>")
+		}
+		if c.Logging.Subsystems == nil {
+			c.Logging.Subsystems = make(map[string]string)
+		}
+		c.Logging.Subsystems[name] = level
+		return nil
+	})
+	set("log-sample", "Log at most this many records per map each second, 0 logs everything", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Logging.SamplePerSecond = n
+		return err
+	})
+	fs.BoolFunc("debug", "Shorthand for -log-level debug", func(string) error {
+		overrides = append(overrides, func(c *Config) error {
+			c.Logging.Level = "debug"
+			return nil
+		})
+		return nil
+	})
+
+	set("queue-size", "Maximum number of changes queued for an unreachable peer before falling back to a full resync (default 10000)", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Queue.Size = n
+		return err
+	})
+	str("queue-dir", "Directory to persist the outbound queue in, kept in memory only if empty", func(c *Config) *string { return &c.Queue.Dir })
+	set("batch-window", "How long to collect and coalesce local changes before sending them, 0 sends them right away", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Batch.Window = d
+		return err
+	})
+	set("batch-max-size", "Most changes sent to a peer at once (default 500)", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Batch.MaxSize = n
+		return err
+	})
+	str("changelog-dir", "Directory to write the log of replicated changes to, disabled if empty", func(c *Config) *string { return &c.ChangeLog.Dir })
+	num("changelog-segment-size", "Size in bytes at which the change log starts a new segment (default 64MiB)", func(c *Config) *int64 { return &c.ChangeLog.SegmentSize })
+	num("changelog-retention-size", "Remove the oldest change log segments once all of them exceed this many bytes, 0 keeps everything", func(c *Config) *int64 { return &c.ChangeLog.RetentionSize })
+	set("changelog-retention-age", "Remove change log segments older than this, 0 keeps everything", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.ChangeLog.RetentionMaxAge = d
+		return err
+	})
+
+	// Kept from when the peer and the port were the only settings: the peer
+	// listens on the same port as we do.
+	var ip string
+	fs.StringVar(&ip, "ip", "", "Server IP address of the peer (to sync to), on the same port as -listen")
+	var compression string
+	fs.StringVar(&compression, "compression", "", "Compress changes sent to every peer with this compressor ("+strings.Join(compressors, ", ")+"), or none")
+
+	return func(c *Config) error {
+		for _, o := range overrides {
+			if err := o(c); err != nil {
+				return err
+			}
+		}
+		if ip != "" {
+			port, err := c.listenPort()
+			if err != nil {
+				return fmt.Errorf("-ip: %w", err)
+			}
+			c.Peers = append(c.Peers, PeerConfig{Address: net.JoinHostPort(ip, strconv.Itoa(int(port)))})
+		}
+		if compression != "" {
+			for i := range c.Peers {
+				c.Peers[i].Compression = compression
+			}
+		}
+		c.setDefaults()
+		return c.validate()
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	pinned := func(c *Config, m MapConfig) {
+		m.Pin = "/sys/fs/bpf/" + m.Name
+		c.Maps = append(c.Maps, m)
+	}
+	gossip := func(c *Config) { c.Gossip.Advertise = "10.0.0.1:50051" }
+	raft := func(c *Config) {
+		c.Raft.Dir = "/var/lib/map-sync/raft"
+		c.Raft.Members = []RaftMember{{Name: "a", Address: "10.0.0.1:50051"}, {Name: "b", Address: "10.0.0.2:50051"}}
+	}
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string // Path of the setting in error, none if valid
+	}{
+		{name: "defaults", change: func(c *Config) {}},
+		{name: "no node name", change: func(c *Config) { c.Node.Name = "" }, want: "node.name"},
+		{name: "bad listen", change: func(c *Config) { c.Listen = "50051" }, want: "listen"},
+		{name: "bad attach", change: func(c *Config) { c.Attach = "uprobe" }, want: "attach"},
+		{name: "peer", change: func(c *Config) { c.Peers = []PeerConfig{{Address: "10.0.0.2:50051", Compression: "gzip"}} }},
+		{name: "peer without port", change: func(c *Config) { c.Peers = []PeerConfig{{Address: "10.0.0.2"}} }, want: "peers[0].address"},
+		{name: "duplicate peer", change: func(c *Config) { c.Peers = []PeerConfig{{Address: "10.0.0.2:1"}, {Address: "10.0.0.2:1"}} }, want: "peers[1].address"},
+		{name: "bad compression", change: func(c *Config) { c.Peers = []PeerConfig{{Address: "10.0.0.2:1", Compression: "lz4"}} }, want: "peers[0].compression"},
+		{name: "no maps", change: func(c *Config) { c.Maps = nil }, want: "maps"},
+		{name: "duplicate map", change: func(c *Config) { c.Maps = append(c.Maps, MapConfig{Name: "hash_map"}) }, want: "maps[1].name"},
+		{name: "unpinned map", change: func(c *Config) { c.Maps = append(c.Maps, MapConfig{Name: "flows"}) }, want: "maps[1].pin"},
+		{name: "bad replicate", change: func(c *Config) { c.Maps[0].Replicate = "sometimes" }, want: "maps[0].replicate"},
+		{name: "raft map without raft", change: func(c *Config) { c.Maps[0].Replicate = REPLICATE_RAFT }, want: "maps[0].replicate"},
+		{name: "raft map", change: func(c *Config) { raft(c); c.Maps[0].Replicate = REPLICATE_RAFT }},
+		{name: "raft without this node", change: func(c *Config) { raft(c); c.Node.Name = "c" }, want: "raft.members"},
+		{name: "raft without dir", change: func(c *Config) { raft(c); c.Raft.Dir = "" }, want: "raft.dir"},
+		{name: "raft heartbeat too slow", change: func(c *Config) { c.Raft.HeartbeatInterval = 2 * c.Raft.ElectionTimeout }, want: "raft.heartbeat_interval"},
+		{name: "filtered raft map", change: func(c *Config) {
+			raft(c)
+			c.Maps[0].Replicate = REPLICATE_RAFT
+			c.Maps[0].Filters = []FilterRule{{Action: FILTER_SKIP}}
+		}, want: "maps[0].filters"},
+		{name: "ownership", change: func(c *Config) { gossip(c); c.Maps[0].Ownership = OWNERSHIP_FORWARD }},
+		{name: "ownership without gossip", change: func(c *Config) { c.Maps[0].Ownership = OWNERSHIP_REJECT }, want: "maps[0].ownership"},
+		{name: "ownership of a sent map", change: func(c *Config) {
+			gossip(c)
+			c.Maps[0].Ownership = OWNERSHIP_FORWARD
+			c.Maps[0].Replicate = REPLICATE_SEND
+		}, want: "maps[0].ownership"},
+		{name: "ttl", change: func(c *Config) { c.Maps[0].TTL = time.Minute }},
+		{name: "ttl of a sent map", change: func(c *Config) { c.Maps[0].TTL = time.Minute; c.Maps[0].Replicate = REPLICATE_SEND }},
+		{name: "negative ttl", change: func(c *Config) { c.Maps[0].TTL = -time.Minute }, want: "maps[0].ttl"},
+		{name: "ttl of a raft map", change: func(c *Config) {
+			raft(c)
+			c.Maps[0].Replicate = REPLICATE_RAFT
+			c.Maps[0].TTL = time.Minute
+		}, want: "maps[0].ttl"},
+		{name: "ttl of a rejecting owned map", change: func(c *Config) {
+			gossip(c)
+			c.Maps[0].Ownership = OWNERSHIP_REJECT
+			c.Maps[0].TTL = time.Minute
+		}},
+		{name: "ttl of a forwarding owned map", change: func(c *Config) {
+			gossip(c)
+			c.Maps[0].Ownership = OWNERSHIP_FORWARD
+			c.Maps[0].TTL = time.Minute
+		}, want: "maps[0].ttl"},
+		{name: "dead origin without gossip", change: func(c *Config) { c.Maps[0].DeadOrigin = DEAD_ORIGIN_PURGE }, want: "maps[0].dead_origin"},
+		{name: "dead origin of a sent map", change: func(c *Config) {
+			gossip(c)
+			c.Maps[0].DeadOrigin = DEAD_ORIGIN_REASSIGN
+			c.Maps[0].Replicate = REPLICATE_SEND
+		}, want: "maps[0].dead_origin"},
+		{name: "transforms of a sent map", change: func(c *Config) {
+			c.Maps[0].Replicate = REPLICATE_SEND
+			c.Maps[0].Transforms = []TransformConfig{{Type: "zero"}}
+		}, want: "maps[0].transforms"},
+		{name: "second map", change: func(c *Config) { pinned(c, MapConfig{Name: "flows", Replicate: REPLICATE_RECEIVE}) }},
+		{name: "key too large", change: func(c *Config) { pinned(c, MapConfig{Name: "flows", KeySize: MAX_KEY_SIZE + 1}) }, want: "maps[1].key_size"},
+		{name: "seeds without advertise", change: func(c *Config) { c.Gossip.Seeds = []string{"10.0.0.2:50051"} }, want: "gossip.advertise"},
+		{name: "probe timeout over interval", change: func(c *Config) { c.Gossip.ProbeTimeout = 2 * c.Gossip.Interval }, want: "gossip.probe_timeout"},
+		{name: "unknown discovery", change: func(c *Config) { c.Discovery = []DiscoveryConfig{{Type: "consul"}} }, want: "discovery[0].type"},
+		{name: "tls cert without key", change: func(c *Config) { c.TLS.Cert = "node.crt" }, want: "tls.cert"},
+		{name: "bad log level", change: func(c *Config) { c.Logging.Level = "loud" }, want: "logging.level"},
+		{name: "unknown subsystem", change: func(c *Config) { c.Logging.Subsystems = map[string]string{"disk": "debug"} }, want: "logging.subsystems.disk"},
+		{name: "empty queue", change: func(c *Config) { c.Queue.Size = 0 }, want: "queue.size"},
+		{name: "negative batch window", change: func(c *Config) { c.Batch.Window = -time.Second }, want: "batch.window"},
+		{name: "empty changelog segments", change: func(c *Config) { c.ChangeLog.SegmentSize = 0 }, want: "changelog.segment_size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.Node.Name = "a"
+			tt.change(&c)
+			err := c.validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("valid config refused: %v", err)
+				}
+				return
+			}
+			var fe *fieldError
+			if !errors.As(err, &fe) {
+				t.Fatalf("error %v, want one about %s", err, tt.want)
+			}
+			if fe.path != tt.want {
+				t.Errorf("error about %s (%v), want one about %s", fe.path, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string // Part of the error, none if valid
+	}{
+		{name: "valid", yaml: "node:\n  name: a\npeers:\n  - address: 10.0.0.2:50051\n"},
+		{name: "unknown setting", yaml: "node:\n  name: a\npeer: 10.0.0.2:50051\n", wantErr: "field peer not found"},
+		{name: "line of the invalid setting", yaml: "node:\n  name: a\npeers:\n  - address: 10.0.0.2:50051\n  - address: nope\n", wantErr: ":5: peers[1].address"},
+		{name: "not yaml", yaml: "node: [\n", wantErr: "config.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("valid config refused: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "node:\n  name: a\ndiscovery:\n  - type: file\n    path: /etc/map-sync/peers\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Discovery[0].Interval != defaultDiscoveryInterval {
+		t.Errorf("discovery interval %s, want the default %s", cfg.Discovery[0].Interval, defaultDiscoveryInterval)
+	}
+	if cfg.Listen != defaultConfig().Listen || len(cfg.Maps) != 1 || cfg.Maps[0].Name != ownMapName {
+		t.Errorf("defaults not kept: listen %q, maps %v", cfg.Listen, cfg.Maps)
+	}
+	// Validating doesn't change the config.
+	before := cfg
+	before.Discovery = append([]DiscoveryConfig(nil), cfg.Discovery...)
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Discovery[0] != before.Discovery[0] {
+		t.Errorf("validate changed discovery[0] to %+v", cfg.Discovery[0])
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Discovery finds peers outside of the config, e.g. in DNS or Kubernetes.
+type Discovery interface {
+	// Watch sends the addresses of the peers found whenever they change,
+	// until ctx is done.
+	Watch(ctx context.Context, found chan<- []string) error
+}
+
+// discoveryBackends creates the Discovery of every type of discovery config.
+// Other backends are added with registerDiscovery, typically from an init
+// function in their own file.
+var discoveryBackends = map[string]func(DiscoveryConfig) (Discovery, error){}
+
+func registerDiscovery(typ string, newDiscovery func(DiscoveryConfig) (Discovery, error)) {
+	discoveryBackends[typ] = newDiscovery
+}
+
+func init() {
+	registerDiscovery(DISCOVERY_FILE, newFileDiscovery)
+	registerDiscovery(DISCOVERY_DNS, newDNSDiscovery)
+	registerDiscovery(DISCOVERY_KUBERNETES, newKubernetesDiscovery)
+}
+
+func newDiscovery(dc DiscoveryConfig) (Discovery, error) {
+	newDiscovery, ok := discoveryBackends[dc.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown discovery type %q", dc.Type)
+	}
+	return newDiscovery(dc)
+}
+
+// poll calls lookup every interval and sends what it found when it changed.
+func poll(ctx context.Context, interval time.Duration, found chan<- []string, lookup func(context.Context) ([]string, error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	return follow(ctx, found, lookup, func() error {
+		select {
+		case <-ticker.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// follow calls lookup, and again whenever wait returns without an error, and
+// sends what it found when it changed.
+func follow(ctx context.Context, found chan<- []string, lookup func(context.Context) ([]string, error), wait func() error) error {
+	var last []string
+	for first := true; ; first = false {
+		peers, err := lookup(ctx)
+		if err != nil {
+			// Keep the peers found last, the source may be briefly unavailable.
+			membershipLog.Warn("Peer discovery failed", "error", err)
+		} else {
+			sort.Strings(peers)
+			peers = slices.Compact(peers)
+			if first || !slices.Equal(peers, last) {
+				select {
+				case found <- peers:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				last = peers
+			}
+		}
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+}
+
+// fileDiscovery reads peers from a file with an address per line, re-read
+// when it changes. Empty lines and lines starting with # are skipped. The
+// file's directory is watched with inotify, so that files replaced by a
+// rename, e.g. those of a Kubernetes ConfigMap, are followed too; where it
+// can't be, the file is read every interval.
+type fileDiscovery struct {
+	path     string
+	interval time.Duration
+}
+
+func newFileDiscovery(dc DiscoveryConfig) (Discovery, error) {
+	if dc.Path == "" {
+		return nil, fmt.Errorf("path must be set")
+	}
+	return &fileDiscovery{path: dc.Path, interval: dc.Interval}, nil
+}
+
+func (d *fileDiscovery) Watch(ctx context.Context, found chan<- []string) error {
+	lookup := func(context.Context) ([]string, error) {
+		data, err := os.ReadFile(d.path)
+		if err != nil {
+			return nil, err
+		}
+		var peers []string
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; s.Scan(); line++ {
+			addr := strings.TrimSpace(s.Text())
+			if addr == "" || strings.HasPrefix(addr, "#") {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", d.path, line, err)
+			}
+			peers = append(peers, addr)
+		}
+		return peers, nil
+	}
+
+	changed, err := watchDir(ctx, filepath.Dir(d.path))
+	if err != nil {
+		membershipLog.Warn("Failed to watch the peers file, reading it every interval instead", "path", d.path, "interval", d.interval, "error", err)
+		return poll(ctx, d.interval, found, lookup)
+	}
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	return follow(ctx, found, lookup, func() error {
+		if ticker == nil {
+			select {
+			case _, ok := <-changed:
+				if ok {
+					return nil
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			membershipLog.Warn("Stopped watching the peers file, reading it every interval instead", "path", d.path, "interval", d.interval)
+			ticker = time.NewTicker(d.interval)
+		}
+		select {
+		case <-ticker.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// watchDir returns a channel receiving a value whenever a file is written to,
+// or moved into, dir, until ctx is done. It's closed when the watch ends,
+// e.g. because dir was removed.
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("watching %s: %w", dir, err)
+	}
+	// Non-blocking, so that closing the file ends a pending read.
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer close(changed)
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					membershipLog.Warn("Failed to read inotify events", "dir", dir, "error", err)
+				}
+				return
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				mask := binary.NativeEndian.Uint32(buf[off+4:])
+				if mask&unix.IN_IGNORED != 0 {
+					// The watch was removed along with dir.
+					return
+				}
+				off += unix.SizeofInotifyEvent + int(binary.NativeEndian.Uint32(buf[off+12:]))
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed, nil
+}
+
+// dnsDiscovery finds peers in the SRV records of a name, or in its A and AAAA
+// records when a port is given, e.g. those of a Kubernetes headless service.
+type dnsDiscovery struct {
+	name     string
+	port     string
+	interval time.Duration
+}
+
+func newDNSDiscovery(dc DiscoveryConfig) (Discovery, error) {
+	if dc.Name == "" {
+		return nil, fmt.Errorf("name must be set")
+	}
+	if dc.Port != "" {
+		if _, err := strconv.ParseUint(dc.Port, 10, 16); err != nil {
+			return nil, fmt.Errorf("port must be a number")
+		}
+	}
+	return &dnsDiscovery{name: dc.Name, port: dc.Port, interval: dc.Interval}, nil
+}
+
+func (d *dnsDiscovery) Watch(ctx context.Context, found chan<- []string) error {
+	return poll(ctx, d.interval, found, func(ctx context.Context) ([]string, error) {
+		var peers []string
+		if d.port == "" {
+			_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.name)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range records {
+				peers = append(peers, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+			}
+			return peers, nil
+		}
+		ips, err := net.DefaultResolver.LookupHost(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			peers = append(peers, net.JoinHostPort(ip, d.port))
+		}
+		return peers, nil
+	})
+}
+
+// discover runs the discovery backends of cfg and keeps the peers in line
+// with what they find.
+func (n *Node) discover(cfg []DiscoveryConfig) error {
+	n.discovered = make([][]string, len(cfg))
+	for i, dc := range cfg {
+		d, err := newDiscovery(dc)
+		if err != nil {
+			return fmt.Errorf("discovery[%d]: %w", i, err)
+		}
+		found := make(chan []string)
+		go func() {
+			if err := d.Watch(context.Background(), found); err != nil {
+				membershipLog.Error("Peer discovery stopped", "type", dc.Type, "error", err)
+			}
+		}()
+		go func() {
+			for peers := range found {
+				count := new(expvar.Int)
+				count.Set(int64(len(peers)))
+				discoveredPeers.Set(fmt.Sprintf("%d:%s", i, dc.Type), count)
+				membershipLog.Debug("Discovered peers", "type", dc.Type, "peers", peers)
+				// The listen address only changes on restart. Names are
+				// resolved, so not with the lock held.
+				n.mu.RLock()
+				listen := n.cfg.Listen
+				n.mu.RUnlock()
+				peers = slices.DeleteFunc(peers, func(addr string) bool { return isLocal(addr, listen) })
+				n.mu.Lock()
+				n.discovered[i] = peers
+				n.mu.Unlock()
+				n.refreshPeers()
+			}
+		}()
+	}
+	return nil
+}
+
+// How long resolving a discovered name may take.
+const resolveTimeout = 5 * time.Second
+
+// isLocal reports whether addr is the address of the server listening on
+// listen, i.e. of this node. Names, e.g. the SRV targets of a headless
+// service, are resolved first.
+func isLocal(addr, listen string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	_, listenPort, _ := net.SplitHostPort(listen)
+	if port != listenPort {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			membershipLog.Debug("Failed to resolve discovered peer", "peer", addr, "error", err)
+			return false
+		}
+		ips = ips[:0]
+		for _, a := range resolved {
+			ips = append(ips, a.IP)
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, ip := range ips {
+			if ipnet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
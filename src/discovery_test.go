@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIsLocal(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "127.0.0.1:50051", want: true},
+		{addr: "localhost:50051", want: true},
+		{addr: "127.0.0.1:50052"},
+		{addr: "192.0.2.1:50051"},
+		{addr: "not-a-host.invalid:50051"},
+		{addr: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := isLocal(tt.addr, ":50051"); got != tt.want {
+			t.Errorf("isLocal(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func receivePeers(t *testing.T, found <-chan []string) []string {
+	t.Helper()
+	select {
+	case peers := <-found:
+		return peers
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers found")
+		return nil
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	write := func(data string) {
+		// Replaced like a ConfigMap, or by most editors.
+		if err := os.WriteFile(path+".tmp", []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# peers\n10.0.0.2:50051\n\n10.0.0.1:50051\n")
+
+	// Never read again on the interval, only when it changes.
+	d, err := newFileDiscovery(DiscoveryConfig{Path: path, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	found := make(chan []string)
+	go d.Watch(ctx, found)
+
+	if got, want := receivePeers(t, found), []string{"10.0.0.1:50051", "10.0.0.2:50051"}; !slices.Equal(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+	// Invalid files keep the peers found last.
+	write("10.0.0.3\n")
+	write("10.0.0.3:50051\n")
+	if got, want := receivePeers(t, found), []string{"10.0.0.3:50051"}; !slices.Equal(got, want) {
+		t.Errorf("found %v after the file changed, want %v", got, want)
+	}
+	if err := os.WriteFile(path, []byte("10.0.0.4:50051\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receivePeers(t, found), []string{"10.0.0.4:50051"}; !slices.Equal(got, want) {
+		t.Errorf("found %v after the file was written to, want %v", got, want)
+	}
+}
+
+func TestFileDiscoveryPollsUnwatchable(t *testing.T) {
+	d, err := newFileDiscovery(DiscoveryConfig{Path: filepath.Join(t.TempDir(), "missing", "peers"), Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	found := make(chan []string)
+	go d.Watch(ctx, found)
+
+	dir := filepath.Dir(d.(*fileDiscovery).path)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "peers"), []byte("10.0.0.2:50051\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receivePeers(t, found), []string{"10.0.0.2:50051"}; !slices.Equal(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// How often entries are checked for expiry.
+const expiryInterval = time.Second
+
+// expireEntries deletes the entries of maps with a TTL that weren't
+// refreshed within it.
+func (n *Node) expireEntries() {
+	for range time.Tick(expiryInterval) {
+		n.mu.RLock()
+		n.origins.mu.Lock()
+		for name, r := range n.origins.maps {
+			sm, ok := n.maps[name]
+			if !ok || !sm.cfg.tracksOrigins() {
+				// Removed, or no longer tracked.
+				n.origins.drop(name)
+				continue
+			}
+			if sm.cfg.TTL <= 0 {
+				continue
+			}
+			deadline := time.Now().Add(-sm.cfg.TTL)
+			for el := r.order.Front(); el != nil; el = r.order.Front() {
+				rf := el.Value.(*refresh)
+				if rf.at.After(deadline) {
+					break
+				}
+				r.remove(el)
+				n.expire(sm, []byte(rf.key), rf.origin)
+			}
+		}
+		n.origins.mu.Unlock()
+		n.mu.RUnlock()
+	}
+}
+
+// expire deletes an entry that wasn't refreshed within the TTL. Called with
+// n.mu held.
+func (n *Node) expire(sm *syncedMap, key []byte, origin string) {
+	err := sm.m.Delete(key)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return
+	}
+	if err != nil {
+		applyLog.Error("Failed to delete expired entry", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "origin", origin, "error", err)
+		return
+	}
+	expiredEntries.Add(sm.cfg.Name, 1)
+	applyLog.Info("Deleted expired entry", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "origin", origin, "ttl", sm.cfg.TTL)
+	n.mutated(n.name, sm, MAP_DELETE, key, nil)
+}
+
+// resendEntries sends the node's own entries of maps with a TTL to peers
+// every TTL/2, so that they don't expire there while they don't change.
+func (n *Node) resendEntries() {
+	sent := make(map[string]time.Time) // By map name
+	for now := range time.Tick(expiryInterval) {
+		n.mu.RLock()
+		for name, sm := range n.maps {
+			if sm.cfg.TTL <= 0 || !sm.cfg.sends() {
+				continue
+			}
+			// Peers got the entries in the resync when they connected.
+			if last, ok := sent[name]; !ok || now.Sub(last) < sm.cfg.TTL/2 {
+				if !ok {
+					sent[name] = now
+				}
+				continue
+			}
+			sent[name] = now
+			n.resend(sm)
+		}
+		n.mu.RUnlock()
+	}
+}
+
+// resend sends the entries of sm that didn't come from a peer to peers, as
+// far as the filters and key ownership of sm let them. Called with n.mu held.
+func (n *Node) resend(sm *syncedMap) {
+	ms, err := snapshotOf(sm.cfg.Name, sm.m)
+	if err != nil {
+		replicationLog.Error("Failed to read map to send its entries again", "map", sm.cfg.Name, "error", err)
+		return
+	}
+	resent := 0
+	for _, e := range ms.GetEntries() {
+		if n.origins.tracked(sm.cfg.Name, e.GetKey()) || !sm.replicates(MAP_UPDATE, e.GetKey(), e.GetValue()) {
+			continue
+		}
+		if owner, _ := n.owner(e.GetKey()); sm.cfg.owned() && owner != n.name {
+			continue
+		}
+		n.sendToPeers(newValueRequest(sm, MAP_UPDATE, e.GetKey(), e.GetValue(), n.name))
+		resent++
+	}
+	resentEntries.Add(sm.cfg.Name, int64(resent))
+	replicationLog.Debug("Sent entries again for peers to keep them", "map", sm.cfg.Name, "entries", resent, "ttl", sm.cfg.TTL)
+}
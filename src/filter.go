@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// Filter rules applied in the kernel, see bpf/sync.h.
+const (
+	MAX_FILTER_RULES = 8
+	MAX_FILTER_BYTES = 16
+)
+
+// kernelFilter is struct Filter of bpf/sync.h.
+type kernelFilter struct {
+	Count uint32
+	Rules [MAX_FILTER_RULES]kernelFilterRule
+}
+
+type kernelFilterRule struct {
+	Action  uint8 // 0 to send, 1 to skip
+	InValue uint8
+	Len     uint8
+	_       uint8
+	Offset  uint16
+	Mask    [MAX_FILTER_BYTES]byte
+	Match   [MAX_FILTER_BYTES]byte
+}
+
+// filterRule is a FilterRule resolved against the map's layout: the bytes
+// of the key or value at offset, ANDed with mask, must equal match.
+type filterRule struct {
+	skip    bool
+	inValue bool
+	offset  int
+	mask    []byte
+	match   []byte
+}
+
+func compileFilter(r FilterRule, layout *mapLayout) (filterRule, error) {
+	f := filterRule{skip: r.Action == FILTER_SKIP, inValue: r.In == "value", offset: int(r.Offset)}
+	if r.Field == "" {
+		// Checked by validate.
+		f.match, _ = hex.DecodeString(r.Match)
+		f.mask, _ = hex.DecodeString(r.Mask)
+		if r.Mask == "" {
+			f.mask = bytes.Repeat([]byte{0xff}, len(f.match))
+		}
+		return f, nil
+	}
+
+	var t btf.Type
+	if layout != nil {
+		t = layout.Key
+		if f.inValue {
+			t = layout.Value
+		}
+	}
+	if t == nil {
+		return f, fmt.Errorf("the map has no BTF to find field %s in, match bytes instead", r.Field)
+	}
+	offset, ft, err := fieldOf(t, r.Field)
+	if err != nil {
+		return f, err
+	}
+	size, err := btf.Sizeof(ft)
+	if err != nil {
+		return f, fmt.Errorf("field %s: %w", r.Field, err)
+	}
+	f.offset += offset
+	f.mask, f.match, err = parseEquals(r.Equals, size)
+	if err != nil {
+		return f, fmt.Errorf("equals: %w", err)
+	}
+	return f, nil
+}
+
+// fieldOf returns the offset and type of the field at path, e.g.
+// tuple.saddr, in t.
+func fieldOf(t btf.Type, path string) (int, btf.Type, error) {
+	offset := 0
+	for _, name := range strings.Split(path, ".") {
+		var members []btf.Member
+		switch u := btf.UnderlyingType(t).(type) {
+		case *btf.Struct:
+			members = u.Members
+		case *btf.Union:
+			members = u.Members
+		default:
+			return 0, nil, fmt.Errorf("field %s: %s is not a struct", path, t)
+		}
+		m, bits, ok := findMember(members, name)
+		if !ok {
+			return 0, nil, fmt.Errorf("field %s: no member named %s", path, name)
+		}
+		if m.BitfieldSize > 0 || bits%8 != 0 {
+			return 0, nil, fmt.Errorf("field %s: bitfields can't be matched", path)
+		}
+		offset += int(bits / 8)
+		t = m.Type
+	}
+	return offset, t, nil
+}
+
+// findMember finds a member by name, also in anonymous structs and unions,
+// and returns its offset in bits.
+func findMember(members []btf.Member, name string) (btf.Member, btf.Bits, bool) {
+	for _, m := range members {
+		if m.Name == name {
+			return m, m.Offset, true
+		}
+		if m.Name != "" {
+			continue
+		}
+		var inner []btf.Member
+		switch u := btf.UnderlyingType(m.Type).(type) {
+		case *btf.Struct:
+			inner = u.Members
+		case *btf.Union:
+			inner = u.Members
+		}
+		if found, bits, ok := findMember(inner, name); ok {
+			return found, m.Offset + bits, true
+		}
+	}
+	return btf.Member{}, 0, false
+}
+
+// parseEquals returns the mask and bytes a field of size bytes must match
+// to equal s: a number, or an IP address or prefix.
+func parseEquals(s string, size int) (mask, match []byte, err error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		// Addresses are kept in network byte order.
+		match = prefix.Masked().Addr().AsSlice()
+		if len(match) != size {
+			return nil, nil, fmt.Errorf("the field has %d bytes, %s has %d", size, s, len(match))
+		}
+		mask = make([]byte, size)
+		for i := 0; i < prefix.Bits(); i++ {
+			mask[i/8] |= 0x80 >> (i % 8)
+		}
+		return mask, match, nil
+	}
+
+	match, err = encodeField(s, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.Repeat([]byte{0xff}, size), match, nil
+}
+
+// encodeField returns the bytes of a field of size bytes holding s: a number,
+// or an IP address in network byte order.
+func encodeField(s string, size int) ([]byte, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		b := addr.AsSlice()
+		if len(b) != size {
+			return nil, fmt.Errorf("the field has %d bytes, %s has %d", size, s, len(b))
+		}
+		return b, nil
+	}
+	switch size {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("the field has %d bytes, only 1, 2, 4 and 8 byte numbers can be used", size)
+	}
+	var v uint64
+	var err error
+	if strings.HasPrefix(s, "-") {
+		var i int64
+		i, err = strconv.ParseInt(s, 0, size*8)
+		v = uint64(i)
+	} else {
+		v, err = strconv.ParseUint(s, 0, size*8)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a %d byte number nor an IP address", s, size)
+	}
+	b := make([]byte, size)
+	switch size {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		binary.NativeEndian.PutUint16(b, uint16(v))
+	case 4:
+		binary.NativeEndian.PutUint32(b, uint32(v))
+	case 8:
+		binary.NativeEndian.PutUint64(b, v)
+	}
+	return b, nil
+}
+
+func (f filterRule) matches(op MapUpdater, key, value []byte) bool {
+	b := key
+	if f.inValue {
+		// Deletes have no value to match.
+		if op == MAP_DELETE {
+			return false
+		}
+		b = value
+	}
+	if f.offset+len(f.match) > len(b) {
+		return false
+	}
+	for i := range f.match {
+		if b[f.offset+i]&f.mask[i] != f.match[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// replicates reports whether the filters of sm let a change be sent to peers.
+func (sm *syncedMap) replicates(op MapUpdater, key, value []byte) bool {
+	for _, f := range sm.filters {
+		if f.matches(op, key, value) {
+			return !f.skip
+		}
+	}
+	return true
+}
+
+// kernel returns the rule as applied by the kernel.
+func (f filterRule) kernel() (kernelFilterRule, error) {
+	var k kernelFilterRule
+	if len(f.match) > MAX_FILTER_BYTES {
+		return k, fmt.Errorf("compares %d bytes, at most %d can be in the kernel", len(f.match), MAX_FILTER_BYTES)
+	}
+	if f.offset+len(f.match) > MAX_VALUE_SIZE {
+		return k, fmt.Errorf("compares bytes past the largest value reported by the kernel")
+	}
+	if f.skip {
+		k.Action = 1
+	}
+	if f.inValue {
+		k.InValue = 1
+	}
+	k.Len, k.Offset = uint8(len(f.match)), uint16(f.offset)
+	copy(k.Mask[:], f.mask)
+	copy(k.Match[:], f.match)
+	return k, nil
+}
+
+// setKernelFilters makes the kernel apply the filters of the maps in maps
+// with kernel_filters set, and stop applying those of the maps in old that
+// no longer do.
+func setKernelFilters(filters *ebpf.Map, old, maps map[string]*syncedMap) error {
+	wanted := make(map[ebpf.MapID]bool)
+	for _, sm := range maps {
+		if !sm.cfg.KernelFilters || !sm.cfg.sends() {
+			continue
+		}
+		var kf kernelFilter
+		for i, f := range sm.filters {
+			k, err := f.kernel()
+			if err != nil {
+				return fmt.Errorf("map %s: filters[%d]: %w", sm.cfg.Name, i, err)
+			}
+			kf.Rules[i] = k
+		}
+		kf.Count = uint32(len(sm.filters))
+		id := uint32(sm.id)
+		if err := filters.Update(&id, &kf, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("setting the filters of map %s: %w", sm.cfg.Name, err)
+		}
+		wanted[sm.id] = true
+	}
+	for _, sm := range old {
+		if !sm.cfg.KernelFilters || wanted[sm.id] {
+			continue
+		}
+		id := uint32(sm.id)
+		if err := filters.Delete(&id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("removing the filters of map %s: %w", sm.cfg.Name, err)
+		}
+	}
+	return nil
+}
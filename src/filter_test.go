@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// testTupleLayout is a map of flows by their addresses and ports, with the
+// interface they came in on.
+func testTupleLayout() *mapLayout {
+	u16 := &btf.Int{Name: "__u16", Size: 2}
+	u32 := &btf.Int{Name: "__u32", Size: 4}
+	return &mapLayout{
+		Key: &btf.Struct{Name: "tuple", Size: 12, Members: []btf.Member{
+			{Name: "saddr", Type: u32},
+			{Name: "daddr", Type: u32, Offset: 32},
+			{Name: "sport", Type: u16, Offset: 64},
+			{Name: "dport", Type: u16, Offset: 80},
+		}},
+		Value: &btf.Struct{Name: "flow", Size: 4, Members: []btf.Member{{Name: "ifindex", Type: u32}}},
+	}
+}
+
+func tupleKey(saddr, daddr [4]byte, sport, dport uint16) []byte {
+	b := append(saddr[:], daddr[:]...)
+	b = binary.NativeEndian.AppendUint16(b, sport)
+	return binary.NativeEndian.AppendUint16(b, dport)
+}
+
+func TestCompileFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       FilterRule
+		wantOffset int
+		wantMask   []byte
+		wantMatch  []byte
+		wantErr    bool
+	}{
+		{
+			name:      "bytes",
+			rule:      FilterRule{Action: FILTER_SKIP, Offset: 2, Match: "0a00"},
+			wantMask:  []byte{0xff, 0xff},
+			wantMatch: []byte{0x0a, 0x00}, wantOffset: 2,
+		},
+		{
+			name:      "masked bytes",
+			rule:      FilterRule{Action: FILTER_SKIP, Match: "0a00", Mask: "ff0f"},
+			wantMask:  []byte{0xff, 0x0f},
+			wantMatch: []byte{0x0a, 0x00},
+		},
+		{
+			name:      "prefix",
+			rule:      FilterRule{Action: FILTER_SKIP, Field: "daddr", Equals: "10.1.2.3/16"},
+			wantMask:  []byte{0xff, 0xff, 0, 0},
+			wantMatch: []byte{10, 1, 0, 0}, wantOffset: 4,
+		},
+		{
+			name:      "address",
+			rule:      FilterRule{Action: FILTER_SKIP, Field: "saddr", Equals: "10.1.2.3"},
+			wantMask:  []byte{0xff, 0xff, 0xff, 0xff},
+			wantMatch: []byte{10, 1, 2, 3},
+		},
+		{
+			name:      "number",
+			rule:      FilterRule{Action: FILTER_SKIP, Field: "dport", Equals: "53"},
+			wantMask:  []byte{0xff, 0xff},
+			wantMatch: binary.NativeEndian.AppendUint16(nil, 53), wantOffset: 10,
+		},
+		{
+			name:      "value field",
+			rule:      FilterRule{Action: FILTER_SEND, In: "value", Field: "ifindex", Equals: "3"},
+			wantMask:  []byte{0xff, 0xff, 0xff, 0xff},
+			wantMatch: binary.NativeEndian.AppendUint32(nil, 3),
+		},
+		{name: "unknown field", rule: FilterRule{Action: FILTER_SKIP, Field: "proto", Equals: "6"}, wantErr: true},
+		{name: "IPv6 in an IPv4 field", rule: FilterRule{Action: FILTER_SKIP, Field: "saddr", Equals: "fd00::/8"}, wantErr: true},
+		{name: "number too large", rule: FilterRule{Action: FILTER_SKIP, Field: "dport", Equals: "65536"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := compileFilter(tt.rule, testTupleLayout())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if f.offset != tt.wantOffset || !bytes.Equal(f.mask, tt.wantMask) || !bytes.Equal(f.match, tt.wantMatch) {
+				t.Errorf("offset %d mask %x match %x, want offset %d mask %x match %x", f.offset, f.mask, f.match, tt.wantOffset, tt.wantMask, tt.wantMatch)
+			}
+		})
+	}
+
+	if _, err := compileFilter(FilterRule{Action: FILTER_SKIP, Field: "saddr", Equals: "10.0.0.0/8"}, nil); err == nil {
+		t.Error("field of a map without BTF compiled")
+	}
+}
+
+func TestReplicates(t *testing.T) {
+	var filters []filterRule
+	for _, r := range []FilterRule{
+		{Action: FILTER_SEND, Field: "saddr", Equals: "127.0.0.2"},
+		{Action: FILTER_SKIP, Field: "saddr", Equals: "127.0.0.0/8"},
+		{Action: FILTER_SKIP, In: "value", Field: "ifindex", Equals: "1"},
+	} {
+		f, err := compileFilter(r, testTupleLayout())
+		if err != nil {
+			t.Fatal(err)
+		}
+		filters = append(filters, f)
+	}
+	sm := &syncedMap{filters: filters}
+	ifindex := func(i uint32) []byte { return binary.NativeEndian.AppendUint32(nil, i) }
+	remote, loopback := tupleKey([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 1000, 53), tupleKey([4]byte{127, 0, 0, 1}, [4]byte{127, 0, 0, 1}, 1000, 53)
+
+	tests := []struct {
+		name  string
+		op    MapUpdater
+		key   []byte
+		value []byte
+		want  bool
+	}{
+		{name: "no rule matches", key: remote, value: ifindex(3), want: true},
+		{name: "skipped", key: loopback, value: ifindex(3)},
+		{name: "first match wins", key: tupleKey([4]byte{127, 0, 0, 2}, [4]byte{127, 0, 0, 1}, 1000, 53), value: ifindex(1), want: true},
+		{name: "skipped by value", key: remote, value: ifindex(1)},
+		{name: "delete skipped by key", op: MAP_DELETE, key: loopback},
+		{name: "delete not matched by value", op: MAP_DELETE, key: remote, want: true},
+		{name: "short key", key: []byte{127}, value: ifindex(3), want: true},
+	}
+	for _, tt := range tests {
+		op := tt.op
+		if op == 0 {
+			op = MAP_UPDATE
+		}
+		if got := sm.replicates(op, tt.key, tt.value); got != tt.want {
+			t.Errorf("%s: replicates %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The kernel reads the filters as the structs of bpf/sync.h.
+func TestKernelFilterLayout(t *testing.T) {
+	header, err := os.ReadFile("bpf/sync.h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"MAX_FILTER_RULES": MAX_FILTER_RULES, "MAX_FILTER_BYTES": MAX_FILTER_BYTES} {
+		m := regexp.MustCompile(`#define ` + name + ` (\d+)`).FindSubmatch(header)
+		if m == nil || string(m[1]) != fmt.Sprint(want) {
+			t.Errorf("%s is %d, bpf/sync.h defines %q", name, want, m)
+		}
+	}
+
+	if size := binary.Size(kernelFilterRule{}); size != 38 {
+		t.Errorf("struct FilterRule has %d bytes, want 38", size)
+	}
+	if size := binary.Size(kernelFilter{}); size != 308 {
+		t.Errorf("struct Filter has %d bytes, want 308", size)
+	}
+
+	f, err := compileFilter(FilterRule{Action: FILTER_SKIP, In: "value", Offset: 0xa2, Match: "0a0b", Mask: "ff0f"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := f.kernel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.NativeEndian, kernelFilter{Count: 1, Rules: [MAX_FILTER_RULES]kernelFilterRule{k}})
+	want := binary.NativeEndian.AppendUint32(nil, 1)
+	want = append(want, 1, 1, 2, 0)
+	want = binary.NativeEndian.AppendUint16(want, 0xa2)
+	want = append(want, 0xff, 0x0f)
+	want = append(want, make([]byte, MAX_FILTER_BYTES-2)...)
+	want = append(want, 0x0a, 0x0b)
+	if got := b.Bytes()[:len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("filter encoded as %x, want %x", got, want)
+	}
+}
+
+func TestKernelFilterRuleLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		rule FilterRule
+	}{
+		{name: "too many bytes", rule: FilterRule{Action: FILTER_SKIP, Match: fmt.Sprintf("%034x", 1)}},
+		{name: "past the largest value", rule: FilterRule{Action: FILTER_SKIP, Offset: MAX_VALUE_SIZE, Match: "00"}},
+	}
+	for _, tt := range tests {
+		f, err := compileFilter(tt.rule, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.kernel(); err == nil {
+			t.Errorf("%s: rule put in the kernel", tt.name)
+		}
+	}
+}
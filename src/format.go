@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"golang.org/x/sys/unix"
+)
+
+// mapLayout holds the BTF types of a map's key and value, used to print them
+// with named fields. A nil *mapLayout, or a nil type, prints as hex.
+type mapLayout struct {
+	Key, Value btf.Type
+}
+
+// bpf_map_info up to the fields we need, see include/uapi/linux/bpf.h. The
+// kernel fills in as much of it as we ask for.
+type bpfMapInfo struct {
+	Type                  uint32
+	ID                    uint32
+	KeySize               uint32
+	ValueSize             uint32
+	MaxEntries            uint32
+	MapFlags              uint32
+	Name                  [BPF_NAME_LEN]byte
+	Ifindex               uint32
+	BTFVmlinuxValueTypeID uint32
+	NetnsDev              uint64
+	NetnsIno              uint64
+	BTFID                 uint32
+	BTFKeyTypeID          uint32
+	BTFValueTypeID        uint32
+	_                     uint32
+}
+
+// mapBTFInfo returns the BTF object and the key and value type IDs of m.
+// cilium/ebpf doesn't expose the type IDs, so ask the kernel directly.
+func mapBTFInfo(m *ebpf.Map) (*bpfMapInfo, error) {
+	var info bpfMapInfo
+	// info is a __u64 in the kernel's attr, which is a pointer on the 64-bit targets we build for.
+	attr := struct {
+		fd      uint32
+		infoLen uint32
+		info    unsafe.Pointer
+	}{
+		fd:      uint32(m.FD()),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    unsafe.Pointer(&info),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_OBJ_GET_INFO_BY_FD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &info, nil
+}
+
+// loadMapLayout reads the key and value types of m from the kernel. It
+// returns nil if the map was created without BTF.
+func loadMapLayout(m *ebpf.Map) (*mapLayout, error) {
+	info, err := mapBTFInfo(m)
+	if err != nil {
+		return nil, err
+	}
+	if info.BTFID == 0 {
+		return nil, nil
+	}
+
+	h, err := btf.NewHandleFromID(btf.ID(info.BTFID))
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	spec, err := h.Spec(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &mapLayout{}
+	if info.BTFKeyTypeID != 0 {
+		if l.Key, err = spec.TypeByID(btf.TypeID(info.BTFKeyTypeID)); err != nil {
+			return nil, err
+		}
+	}
+	if info.BTFValueTypeID != 0 {
+		if l.Value, err = spec.TypeByID(btf.TypeID(info.BTFValueTypeID)); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// marshal encodes the layout as raw BTF, so it can travel along with map
+// contents. It returns no BTF for a nil layout.
+func (l *mapLayout) marshal() (raw []byte, keyID, valueID uint32, err error) {
+	if l == nil {
+		return nil, 0, 0, nil
+	}
+	b, err := btf.NewBuilder(nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	add := func(t btf.Type) (uint32, error) {
+		if t == nil {
+			return 0, nil
+		}
+		id, err := b.Add(t)
+		return uint32(id), err
+	}
+	if keyID, err = add(l.Key); err != nil {
+		return nil, 0, 0, err
+	}
+	if valueID, err = add(l.Value); err != nil {
+		return nil, 0, 0, err
+	}
+	raw, err = b.Marshal(nil, nil)
+	return raw, keyID, valueID, err
+}
+
+// hash identifies the layout, so nodes can tell whether they agree on it. A
+// nil layout, or one that can't be encoded, has an empty hash.
+func (l *mapLayout) hash() string {
+	raw, keyID, valueID, err := l.marshal()
+	if err != nil || raw == nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(raw)
+	binary.Write(h, binary.LittleEndian, [2]uint32{keyID, valueID})
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// unmarshalMapLayout is the reverse of marshal.
+func unmarshalMapLayout(raw []byte, keyID, valueID uint32) (*mapLayout, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	spec, err := btf.LoadSpecFromReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	l := &mapLayout{}
+	if keyID != 0 {
+		if l.Key, err = spec.TypeByID(btf.TypeID(keyID)); err != nil {
+			return nil, err
+		}
+	}
+	if valueID != 0 {
+		if l.Value, err = spec.TypeByID(btf.TypeID(valueID)); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *mapLayout) formatKey(b []byte) string {
+	if l == nil {
+		return formatBTF(nil, b)
+	}
+	return formatBTF(l.Key, b)
+}
+
+func (l *mapLayout) formatValue(b []byte) string {
+	if l == nil {
+		return formatBTF(nil, b)
+	}
+	return formatBTF(l.Value, b)
+}
+
+// formatBTF prints b as a value of type t, e.g. {saddr=16777343 dport=80}.
+// Whatever can't be decoded is printed as hex.
+func formatBTF(t btf.Type, b []byte) string {
+	var sb strings.Builder
+	writeBTF(&sb, t, b)
+	return sb.String()
+}
+
+func writeBTF(w *strings.Builder, t btf.Type, b []byte) {
+	if t == nil {
+		w.WriteString(hex.EncodeToString(b))
+		return
+	}
+	t = btf.UnderlyingType(t)
+	size, err := btf.Sizeof(t)
+	if err != nil || size > len(b) {
+		w.WriteString(hex.EncodeToString(b))
+		return
+	}
+	b = b[:size]
+
+	switch t := t.(type) {
+	case *btf.Int:
+		switch {
+		case t.Encoding == btf.Bool:
+			w.WriteString(strconv.FormatBool(readUint(b) != 0))
+		case t.Encoding == btf.Signed:
+			w.WriteString(strconv.FormatInt(readInt(b), 10))
+		default:
+			w.WriteString(strconv.FormatUint(readUint(b), 10))
+		}
+
+	case *btf.Enum:
+		v := readUint(b)
+		for _, ev := range t.Values {
+			if ev.Value == v {
+				w.WriteString(ev.Name)
+				return
+			}
+		}
+		if t.Signed {
+			w.WriteString(strconv.FormatInt(readInt(b), 10))
+		} else {
+			w.WriteString(strconv.FormatUint(v, 10))
+		}
+
+	case *btf.Struct:
+		writeMembers(w, t.Members, b)
+	case *btf.Union:
+		writeMembers(w, t.Members, b)
+
+	case *btf.Array:
+		elem := btf.UnderlyingType(t.Type)
+		if i, ok := elem.(*btf.Int); ok && i.Size == 1 && (i.Encoding == btf.Char || strings.Contains(i.Name, "char")) {
+			w.WriteString(strconv.Quote(cString(b)))
+			return
+		}
+		elemSize, err := btf.Sizeof(elem)
+		if err != nil || elemSize == 0 {
+			w.WriteString(hex.EncodeToString(b))
+			return
+		}
+		w.WriteByte('[')
+		for i := 0; i < int(t.Nelems) && (i+1)*elemSize <= len(b); i++ {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			writeBTF(w, elem, b[i*elemSize:(i+1)*elemSize])
+		}
+		w.WriteByte(']')
+
+	case *btf.Pointer:
+		fmt.Fprintf(w, "0x%x", readUint(b))
+
+	default:
+		w.WriteString(hex.EncodeToString(b))
+	}
+}
+
+func writeMembers(w *strings.Builder, members []btf.Member, b []byte) {
+	w.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			w.WriteByte(' ')
+		}
+		if m.Name != "" {
+			w.WriteString(m.Name)
+			w.WriteByte('=')
+		}
+		off := int(m.Offset / 8)
+		if off > len(b) {
+			w.WriteString("?")
+			continue
+		}
+		if m.BitfieldSize > 0 {
+			// Bitfields are read from the bytes they start in, assuming little endian.
+			var word [8]byte
+			copy(word[:], b[off:])
+			v := binary.LittleEndian.Uint64(word[:]) >> (m.Offset % 8)
+			v &= (1 << m.BitfieldSize) - 1
+			w.WriteString(strconv.FormatUint(v, 10))
+			continue
+		}
+		writeBTF(w, m.Type, b[off:])
+	}
+	w.WriteByte('}')
+}
+
+func readUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.NativeEndian.Uint16(b))
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b))
+	case 8:
+		return binary.NativeEndian.Uint64(b)
+	}
+	return 0
+}
+
+func readInt(b []byte) int64 {
+	switch len(b) {
+	case 1:
+		return int64(int8(b[0]))
+	case 2:
+		return int64(int16(binary.NativeEndian.Uint16(b)))
+	case 4:
+		return int64(int32(binary.NativeEndian.Uint32(b)))
+	case 8:
+		return int64(binary.NativeEndian.Uint64(b))
+	}
+	return 0
+}
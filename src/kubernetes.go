@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where pods find the API server and their service account.
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	inClusterAPI      = "https://kubernetes.default.svc"
+)
+
+// kubernetesDiscovery finds peers in the Endpoints of a service, i.e. the
+// ready pods backing it.
+type kubernetesDiscovery struct {
+	endpoints string // URL of the Endpoints object
+	port      string // Name or number, the first port if empty
+	token     string // File holding the bearer token, none if empty
+	client    *http.Client
+	interval  time.Duration
+}
+
+func newKubernetesDiscovery(dc DiscoveryConfig) (Discovery, error) {
+	if dc.Service == "" {
+		return nil, fmt.Errorf("service must be set")
+	}
+	inCluster := dc.APIServer == ""
+	api := dc.APIServer
+	if inCluster {
+		api = inClusterAPI
+		if host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); host != "" && port != "" {
+			api = "https://" + net.JoinHostPort(host, port)
+		}
+	}
+	namespace := dc.Namespace
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("namespace must be set outside of a pod: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	token, ca := dc.TokenFile, dc.CAFile
+	if inCluster {
+		token, ca = or(token, serviceAccountDir+"/token"), or(ca, serviceAccountDir+"/ca.crt")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &kubernetesDiscovery{
+		endpoints: strings.TrimSuffix(api, "/") + "/api/v1/namespaces/" + url.PathEscape(namespace) + "/endpoints/" + url.PathEscape(dc.Service),
+		port:      dc.Port,
+		token:     token,
+		client:    &http.Client{Transport: transport, Timeout: dc.Interval},
+		interval:  dc.Interval,
+	}, nil
+}
+
+func or(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// The parts of an Endpoints object we need.
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+func (d *kubernetesDiscovery) Watch(ctx context.Context, found chan<- []string) error {
+	return poll(ctx, d.interval, found, d.lookup)
+}
+
+func (d *kubernetesDiscovery) lookup(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.endpoints, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.token != "" {
+		// Re-read every time, projected tokens are rotated.
+		token, err := os.ReadFile(d.token)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", d.endpoints, resp.Status)
+	}
+	var ep endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, fmt.Errorf("GET %s: %w", d.endpoints, err)
+	}
+
+	var peers []string
+	for _, s := range ep.Subsets {
+		port := 0
+		for i, p := range s.Ports {
+			if d.port == "" && i == 0 || p.Name == d.port || strconv.Itoa(p.Port) == d.port {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, a := range s.Addresses {
+			peers = append(peers, net.JoinHostPort(a.IP, strconv.Itoa(port)))
+		}
+	}
+	return peers, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testEndpoints = `{
+  "kind": "Endpoints",
+  "subsets": [
+    {
+      "addresses": [{"ip": "10.0.0.1"}, {"ip": "10.0.0.2"}],
+      "notReadyAddresses": [{"ip": "10.0.0.3"}],
+      "ports": [{"name": "metrics", "port": 9090}, {"name": "grpc", "port": 50051}]
+    },
+    {
+      "notReadyAddresses": [{"ip": "10.0.0.4"}],
+      "ports": [{"name": "grpc", "port": 50051}]
+    }
+  ]
+}`
+
+// newTestAPIServer serves testEndpoints as the Endpoints of default/map-sync
+// to requests bearing token, and returns the server with a file holding its
+// CA and one holding token.
+func newTestAPIServer(t *testing.T, token string) (srv *httptest.Server, caFile, tokenFile string) {
+	t.Helper()
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/default/endpoints/map-sync" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testEndpoints))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	caFile, tokenFile = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "token")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile, tokenFile
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	srv, caFile, tokenFile := newTestAPIServer(t, "secret")
+	wrongToken := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(wrongToken, []byte("guess"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dc      DiscoveryConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "first port",
+			dc:   DiscoveryConfig{Service: "map-sync", TokenFile: tokenFile, CAFile: caFile},
+			want: []string{"10.0.0.1:9090", "10.0.0.2:9090"},
+		},
+		{
+			name: "port by name",
+			dc:   DiscoveryConfig{Service: "map-sync", Port: "grpc", TokenFile: tokenFile, CAFile: caFile},
+			want: []string{"10.0.0.1:50051", "10.0.0.2:50051"},
+		},
+		{
+			name: "port by number",
+			dc:   DiscoveryConfig{Service: "map-sync", Port: "50051", TokenFile: tokenFile, CAFile: caFile},
+			want: []string{"10.0.0.1:50051", "10.0.0.2:50051"},
+		},
+		{
+			name: "unknown port",
+			dc:   DiscoveryConfig{Service: "map-sync", Port: "http", TokenFile: tokenFile, CAFile: caFile},
+		},
+		{
+			name:    "unknown service",
+			dc:      DiscoveryConfig{Service: "other", TokenFile: tokenFile, CAFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:    "no token",
+			dc:      DiscoveryConfig{Service: "map-sync", CAFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:    "wrong token",
+			dc:      DiscoveryConfig{Service: "map-sync", TokenFile: wrongToken, CAFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:    "untrusted server",
+			dc:      DiscoveryConfig{Service: "map-sync", TokenFile: tokenFile},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dc.Type, tt.dc.APIServer, tt.dc.Namespace, tt.dc.Interval = DISCOVERY_KUBERNETES, srv.URL, "default", 5*time.Second
+			d, err := newKubernetesDiscovery(tt.dc)
+			if err != nil {
+				t.Fatalf("creating discovery: %v", err)
+			}
+			got, err := d.(*kubernetesDiscovery).lookup(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("found %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubernetesDiscoveryRereadsToken(t *testing.T) {
+	srv, caFile, tokenFile := newTestAPIServer(t, "rotated")
+	if err := os.WriteFile(tokenFile, []byte("expired"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newKubernetesDiscovery(DiscoveryConfig{Type: DISCOVERY_KUBERNETES, Interval: 5 * time.Second, APIServer: srv.URL, Namespace: "default", Service: "map-sync", TokenFile: tokenFile, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.(*kubernetesDiscovery).lookup(context.Background()); err == nil {
+		t.Fatal("lookup with an expired token succeeded")
+	}
+	if err := os.WriteFile(tokenFile, []byte("rotated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.(*kubernetesDiscovery).lookup(context.Background()); err != nil {
+		t.Errorf("lookup after the token was rotated: %v", err)
+	}
+}
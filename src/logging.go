@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Subsystems that can be given their own log level.
+const (
+	SUBSYS_KERNEL      = "kernel"      // Events reported by the BPF programs
+	SUBSYS_REPLICATION = "replication" // Sending changes to peers
+	SUBSYS_APPLY       = "apply"       // Applying changes from peers
+	SUBSYS_MEMBERSHIP  = "membership"  // Peers joining and leaving
+	SUBSYS_RAFT        = "raft"        // Elections and the Raft log of raft maps
+)
+
+var subsystems = []string{SUBSYS_KERNEL, SUBSYS_REPLICATION, SUBSYS_APPLY, SUBSYS_MEMBERSHIP, SUBSYS_RAFT}
+
+// Loggers of each subsystem, replaced by setupLogging.
+var (
+	kernelLog      = slog.Default()
+	replicationLog = slog.Default()
+	applyLog       = slog.Default()
+	membershipLog  = slog.Default()
+	raftLog        = slog.Default()
+)
+
+// setupLogging creates the logger of every subsystem and makes the base
+// handler the default for everything else, including the log package.
+func setupLogging(c LoggingConfig, w io.Writer) error {
+	var base slog.Handler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch c.Format {
+	case "json":
+		base = slog.NewJSONHandler(w, opts)
+	case "", "text", "logfmt":
+		base = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+	if c.SamplePerSecond > 0 {
+		base = newSamplingHandler(base, c.SamplePerSecond)
+	}
+
+	level, err := parseLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(&levelHandler{Handler: base, level: level}))
+
+	loggers := map[string]**slog.Logger{
+		SUBSYS_KERNEL:      &kernelLog,
+		SUBSYS_REPLICATION: &replicationLog,
+		SUBSYS_APPLY:       &applyLog,
+		SUBSYS_MEMBERSHIP:  &membershipLog,
+		SUBSYS_RAFT:        &raftLog,
+	}
+	for name, logger := range loggers {
+		l := level
+		if s, ok := c.Subsystems[name]; ok {
+			if l, err = parseLevel(s); err != nil {
+				return err
+			}
+		}
+		*logger = slog.New(&levelHandler{Handler: base, level: l}).With("subsystem", name)
+	}
+	return nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// levelHandler drops records below its level, so subsystems sharing a
+// handler can log at different levels.
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level && h.Handler.Enabled(ctx, l)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// samplingHandler keeps hot maps from flooding the logs: it passes at most
+// perSecond records below warning level per map each second, and reports how
+// many it dropped once the second is over. Records without a "map" attribute
+// are never dropped.
+type samplingHandler struct {
+	slog.Handler
+	perSecond int
+	state     *samplingState
+}
+
+type samplingState struct {
+	mu      sync.Mutex
+	windows map[string]*samplingWindow
+}
+
+type samplingWindow struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+func newSamplingHandler(h slog.Handler, perSecond int) *samplingHandler {
+	return &samplingHandler{Handler: h, perSecond: perSecond, state: &samplingState{windows: make(map[string]*samplingWindow)}}
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+	var key string
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "map" {
+			key = a.Value.String()
+			return false
+		}
+		return true
+	})
+	if key == "" {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	h.state.mu.Lock()
+	w, ok := h.state.windows[key]
+	if !ok {
+		w = &samplingWindow{start: r.Time}
+		h.state.windows[key] = w
+	}
+	var dropped int
+	if r.Time.Sub(w.start) >= time.Second {
+		dropped = w.dropped
+		w.start, w.count, w.dropped = r.Time, 0, 0
+	}
+	w.count++
+	pass := w.count <= h.perSecond
+	if !pass {
+		w.dropped++
+	}
+	h.state.mu.Unlock()
+
+	if dropped > 0 {
+		summary := slog.NewRecord(r.Time, slog.LevelInfo, "Dropped log records of a hot map", 0)
+		summary.AddAttrs(slog.String("map", key), slog.Int("dropped", dropped))
+		h.Handler.Handle(ctx, summary)
+	}
+	if !pass {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), perSecond: h.perSecond, state: h.state}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), perSecond: h.perSecond, state: h.state}
+}
+
+// fatal logs msg as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
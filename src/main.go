@@ -5,118 +5,472 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"flag"
-	"fmt"
 	"log"
+	"log/slog"
+	"math/rand"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/ringbuf"
 	"github.com/cilium/ebpf/rlimit"
 )
 
-var debug bool = false
-
 var kasp = keepalive.ServerParameters{
 	MaxConnectionIdle: 30 * time.Second, // If a client is idle for 30 seconds, send a GOAWAY
 	Time:              5 * time.Second,  // Ping the client if it is idle for 5 seconds to ensure the connection is still active
 	Timeout:           1 * time.Second,  // Wait 1 second for the ping ack before assuming the connection is dead
 }
 
+// Large enough for a snapshot of a full map.
+const maxMessageSize = 256 << 20
+
 type Node struct {
 	UnimplementedSyncServiceServer
-	syncObjs syncObjects
+	name       string // cfg.Node.Name, which only changes on restart
+	syncObjs   syncObjects
+	changelog  *ChangeLog
+	configPath string
+	applyFlags func(*Config) error
+	watchers   watchHub
+	batcher    *batcher    // nil if local changes are sent right away
+	gossip     *membership // nil if peers are only configured
+	raft       *raft       // nil if no map is replicated through raft
+	raftMaps   *raftMaps
+	proposer   *batcher                  // Collects local changes of raft maps
+	owners     atomic.Pointer[ownerRing] // nil until the members of the cluster are known
+	origins    *origins
+
+	// Serializes reloads, held across reading the config and applying it
+	reloadMu sync.Mutex
+	// Replaced on reload
+	mu    sync.RWMutex
+	cfg   Config
+	maps  map[string]*syncedMap
+	byID  map[uint32]*syncedMap // By kernel map ID
+	byRef map[uint32]*syncedMap // By the ID peers know the map by
+	refs  mapRegistry
+	peers map[string]*Peer
+	// Addresses found by each discovery backend
+	discovered [][]string
 }
 
 func (n *Node) SetValue(ctx context.Context, in *ValueRequest) (*Empty, error) {
-	value := in.GetValue()
-	key := in.GetKey()
-	_type := in.GetType()
+	if err := n.apply(in); err != nil {
+		return nil, err
+	}
+	return &Empty{}, nil
+}
+
+func (n *Node) SetValues(ctx context.Context, in *ValueBatch) (*Empty, error) {
+	// Each change has the outcome it would have if sent alone: changes that
+	// can never be applied are skipped, and those needing a resync don't stop
+	// the rest since the resync overwrites them anyway. Anything else stops
+	// the batch, and the sender retries it whole; replaying changes in order
+	// is harmless.
+	var resync error
+	for _, req := range in.GetChanges() {
+		err := n.apply(req)
+		switch classifySendError(err, MapUpdater(req.GetType())) {
+		case SEND_OK, SEND_DROP:
+		case SEND_RESYNC:
+			if resync == nil {
+				resync = err
+			}
+		default:
+			return nil, err
+		}
+	}
+	if resync != nil {
+		return nil, resync
+	}
+	return &Empty{}, nil
+}
+
+// apply applies a change from a peer, returning a gRPC status error.
+func (n *Node) apply(in *ValueRequest) error {
+	key, value := requestKeyValue(in)
+	_type := MapUpdater(in.GetType())
+
+	sm, err := n.targetMap(in)
+	if err == nil && in.GetForwarded() {
+		err = n.checkForwarded(sm, in)
+	} else if err == nil {
+		err = n.checkOwner(sm, in)
+	}
+	if err != nil {
+		applyErrors.Add(status.Code(err).String(), 1)
+		return err
+	}
+	if in.GetOrigin() == n.name {
+		// The owner of the key sending on a change we forwarded to it, which
+		// is already applied here as we made it.
+		return nil
+	}
+	// Owners send forwarded changes on as they were sent.
+	sentKey, sentValue := key, value
+	if key, value, err = sm.transform(_type, key, value, in.GetOrigin()); err != nil {
+		applyErrors.Add(codes.InvalidArgument.String(), 1)
+		applyLog.Warn("Failed to transform change", "map", sm.cfg.Name, "op", _type, "key", sm.layout.formatKey(sentKey), "origin", in.GetOrigin(), "error", err)
+		return status.Errorf(codes.InvalidArgument, "map %s: %v", sm.cfg.Name, err)
+	}
+
+	// Refreshed before the change is applied, so that it can't expire or be
+	// purged right after.
+	if sm.cfg.tracksOrigins() {
+		if _type == MAP_DELETE {
+			n.origins.forget(sm.cfg.Name, key)
+		} else {
+			n.origins.refresh(sm.cfg.Name, key, in.GetOrigin())
+		}
+	}
 
 	// According to https://man7.org/linux/man-pages/man2/bpf.2.html, these calls are atomic!
-	if MapUpdater(_type).String() == "UPDATE" {
-		n.syncObjs.HashMap.Update(key, value, ebpf.UpdateAny)
-		log.Printf("Client updated key %d to value %d", key, value)
-	} else if MapUpdater(_type).String() == "DELETE" {
-		n.syncObjs.HashMap.Delete(key)
-		log.Printf("Client deleted key %d", key)
+	switch _type {
+	case MAP_UPDATE:
+		err = sm.m.Update(key, value, ebpf.UpdateAny)
+	case MAP_DELETE:
+		err = sm.m.Delete(key)
+	default:
+		applyErrors.Add(codes.InvalidArgument.String(), 1)
+		return status.Errorf(codes.InvalidArgument, "unknown update type %d", in.GetType())
+	}
+	if err != nil {
+		err = applyStatus(err)
+		applyErrors.Add(status.Code(err).String(), 1)
+		applyLog.Warn("Failed to apply change", "map", sm.cfg.Name, "op", _type, "key", sm.layout.formatKey(key), "origin", in.GetOrigin(), "error", err)
+		return err
 	}
 
-	return &Empty{}, nil
+	if _type == MAP_UPDATE {
+		applyLog.Info("Peer updated key", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "value", sm.layout.formatValue(value), "origin", in.GetOrigin())
+	} else {
+		applyLog.Info("Peer deleted key", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "origin", in.GetOrigin())
+	}
+	n.mutated(in.GetOrigin(), sm, _type, key, value)
+	if in.GetForwarded() {
+		// As the owner, we send it on to everyone else.
+		req := newValueRequest(sm, _type, sentKey, sentValue, in.GetOrigin())
+		req.Owner = n.name
+		n.mu.RLock()
+		n.sendToPeers(req)
+		n.mu.RUnlock()
+	}
+	return nil
+}
+
+// localChange sends a change of a local map reported by the kernel to peers.
+func (n *Node) localChange(event *MapData) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	// Events may still be in the ringbuf for a map that was just removed from the allowlist.
+	sm, ok := n.byID[event.MapID]
+	if !ok || !sm.cfg.sends() {
+		return
+	}
+
+	key, value := event.KeyBytes(), event.ValueBytes()
+	kernelLog.Debug("Map changed",
+		"map_id", event.MapID,
+		"map", sm.cfg.Name,
+		"pid", event.PID,
+		"op", event.UpdateType,
+		"key", sm.layout.formatKey(key),
+		"value", sm.layout.formatValue(value))
+	n.replicate(sm, event.UpdateType, key, value)
+}
+
+// replicate sends a change made to a local map on this node to peers, as
+// the filters, replication mode and ownership of the map decide. Called with
+// n.mu held.
+func (n *Node) replicate(sm *syncedMap, op MapUpdater, key, value []byte) {
+	if sm.cfg.tracksOrigins() {
+		// The entry is now this node's own.
+		n.origins.forget(sm.cfg.Name, key)
+	}
+	if !sm.replicates(op, key, value) {
+		filteredChanges.Add(sm.cfg.Name, 1)
+		n.filtered(sm, op, key, value)
+		return
+	}
+	req := newValueRequest(sm, op, key, value, n.name)
+	if sm.cfg.raft() {
+		// Recorded once committed.
+		n.proposer.add(req)
+		return
+	}
+	if sm.cfg.owned() {
+		if owner, addr := n.owner(key); owner != n.name {
+			n.foreignChange(sm, req, owner, addr)
+			return
+		}
+	}
+	n.mutated(n.name, sm, op, key, value)
+	n.sendToPeers(req)
+}
+
+// sendToPeers sends req to every peer, through the batcher if there's one.
+// Called with n.mu held.
+func (n *Node) sendToPeers(req *ValueRequest) {
+	if n.batcher != nil {
+		n.batcher.add(req)
+		return
+	}
+	for _, peer := range n.peers {
+		peer.Enqueue(req)
+	}
+}
+
+// enqueue queues changes collected by the batcher for every peer.
+func (n *Node) enqueue(reqs []*ValueRequest) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, peer := range n.peers {
+		for _, req := range reqs {
+			peer.Enqueue(req)
+		}
+	}
+}
+
+// mutated records a change applied to sm in the change log, if one is configured,
+// and passes it on to watchers.
+func (n *Node) mutated(origin string, sm *syncedMap, op MapUpdater, key, value []byte) {
+	n.record(origin, sm, op, key, value, false)
+}
+
+// filtered records a local change the filters of sm kept from peers like
+// mutated, tagged so that watchers and readers of the change log can tell.
+func (n *Node) filtered(sm *syncedMap, op MapUpdater, key, value []byte) {
+	n.record(n.name, sm, op, key, value, true)
+}
+
+func (n *Node) record(origin string, sm *syncedMap, op MapUpdater, key, value []byte, filtered bool) {
+	if n.watchers.active() {
+		n.watchers.publish(&MapEvent{
+			Time:      time.Now().UnixNano(),
+			Map:       sm.cfg.Name,
+			Type:      int32(op),
+			Key:       key,
+			Value:     value,
+			Origin:    origin,
+			KeyText:   sm.layout.formatKey(key),
+			ValueText: sm.layout.formatValue(value),
+			Filtered:  filtered,
+		})
+	}
+
+	if n.changelog == nil {
+		return
+	}
+	r := ChangeRecord{Origin: origin, Map: sm.cfg.Name, Op: op.String(), Key: hex.EncodeToString(key), Filtered: filtered}
+	if op == MAP_UPDATE {
+		r.Value = hex.EncodeToString(value)
+	}
+	if err := n.changelog.Append(r); err != nil {
+		slog.Error("Failed to write change log record", "error", err)
+	}
 }
 
-func startServer(node *Node, port string) {
-	l, err := net.Listen("tcp", port)
+func startServer(node *Node) {
+	l, err := net.Listen("tcp", node.cfg.Listen)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		fatal("Failed to listen", "error", err)
 	}
 
-	s := grpc.NewServer(grpc.KeepaliveParams(kasp))
+	creds, err := serverCredentials(node.cfg.TLS)
+	if err != nil {
+		fatal("Failed to load TLS credentials", "error", err)
+	}
+	s := grpc.NewServer(creds, grpc.KeepaliveParams(kasp), grpc.MaxRecvMsgSize(maxMessageSize), grpc.MaxSendMsgSize(maxMessageSize),
+		grpc.StatsHandler(newPayloadStats("server")))
 	RegisterSyncServiceServer(s, node)
+	s.RegisterService(&legacyServiceDesc, node)
 
-	log.Printf("Server is running at %s", port)
+	slog.Info("Server is running", "address", node.cfg.Listen)
 	if err := s.Serve(l); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		fatal("Failed to serve", "error", err)
 	}
 }
 
 func main() {
-	serverIP := flag.String("ip", "localhost", "Server IP address of the peer (to sync to)")
-	serverPort := flag.Int("port", 50051, "Current host listen port")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "changelog":
+			changelogCommand(os.Args[2:])
+			return
+		case "snapshot":
+			snapshotCommand(os.Args[2:])
+			return
+		case "reload":
+			reloadCommand(os.Args[2:])
+			return
+		case "inspect":
+			inspectCommand(os.Args[2:])
+			return
+		case "diff":
+			diffCommand(os.Args[2:])
+			return
+		case "watch":
+			watchCommand(os.Args[2:])
+			return
+		}
+	}
+
+	configPath := flag.String("config", "", "Path to the YAML config file")
+	applyFlags := configFlags(flag.CommandLine)
 	flag.Parse()
-	address := *serverIP + ":" + fmt.Sprint(*serverPort)
 
-	// Allow the current process to lock memory for eBPF resources.
-	if err := rlimit.RemoveMemlock(); err != nil {
-		log.Fatal(err)
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+	}
+	if err := applyFlags(&cfg); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if err := setupLogging(cfg.Logging, os.Stderr); err != nil {
+		log.Fatalf("Invalid config: %v", err)
 	}
 
-	// Load pre-compiled programs and maps into the kernel.
-	syncObjs := syncObjects{}
-	if err := loadSyncObjects(&syncObjs, nil); err != nil {
-		log.Fatal(err)
+	if cfg.Metrics != "" {
+		go startMetricsServer(cfg.Metrics)
 	}
-	defer syncObjs.Close()
 
-	fUpdate, err := link.AttachTracing(link.TracingOptions{
-		Program: syncObjs.syncPrograms.BpfProgKernHmapupdate,
-	})
-	if err != nil {
-		log.Fatalf("opening htab_map_update_elem kprobe: %s", err)
+	// Allow the current process to lock memory for eBPF resources.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		fatal("Failed to remove the memlock limit", "error", err)
 	}
-	defer fUpdate.Close()
 
-	fDelete, err := link.AttachTracing(link.TracingOptions{
-		Program: syncObjs.syncPrograms.BpfProgKernHmapdelete,
-	})
+	// Load pre-compiled programs and maps into the kernel, and attach the
+	// programs to the functions changing hash maps.
+	loaded, hooks, err := loadObjects(cfg.Attach)
 	if err != nil {
-		log.Fatalf("opening htab_map_delete_elem kprobe: %s", err)
+		fatal("Failed to load BPF objects", "error", err)
 	}
-	defer fDelete.Close()
+	defer hooks.Close()
+	syncObjs := syncObjects{syncMaps: loaded}
+	defer syncObjs.Close()
 
 	// Update the config map with the server's port and PID.
 	// This is compulsory to prevent the server from sending map updates to itself.
 	// NOTE: this also prevents each server to log eBPF map updates done by the same process that loaded them.
+	port, _ := cfg.listenPort()
 	var key uint32 = 0
 	config := syncConfig{
-		HostPort: uint16(*serverPort),
+		HostPort: port,
 		HostPid:  uint64(os.Getpid()),
 	}
 	err = syncObjs.syncMaps.MapConfig.Update(&key, &config, ebpf.UpdateAny)
 	if err != nil {
-		log.Fatalf("Failed to update the map: %v", err)
+		fatal("Failed to update the config map", "error", err)
+	}
+
+	node := &Node{
+		name:       cfg.Node.Name,
+		syncObjs:   syncObjs,
+		configPath: *configPath,
+		applyFlags: applyFlags,
+		cfg:        cfg,
+		peers:      make(map[string]*Peer),
+		raftMaps:   newRaftMaps(),
+		origins:    newOrigins(),
+		refs:       mapRegistry{epoch: rand.Uint64()},
+	}
+	if cfg.Batch.Window > 0 {
+		node.batcher = newBatcher(cfg.Batch.Window, cfg.Batch.MaxSize, node.enqueue)
+		go node.batcher.run()
+	}
+	if cfg.ChangeLog.Dir != "" {
+		node.changelog, err = OpenChangeLog(ChangeLogOptions{
+			Dir:             cfg.ChangeLog.Dir,
+			SegmentSize:     cfg.ChangeLog.SegmentSize,
+			RetentionSize:   cfg.ChangeLog.RetentionSize,
+			RetentionMaxAge: cfg.ChangeLog.RetentionMaxAge,
+		})
+		if err != nil {
+			fatal("Failed to open the change log", "error", err)
+		}
+		defer node.changelog.Close()
+		go func() {
+			for range time.Tick(time.Minute) {
+				if err := node.changelog.Truncate(); err != nil {
+					slog.Error("Failed to truncate the change log", "error", err)
+				}
+			}
+		}()
+	}
+
+	if cfg.Queue.Dir != "" {
+		if err := os.MkdirAll(cfg.Queue.Dir, 0o700); err != nil {
+			fatal("Failed to create queue directory", "error", err)
+		}
+	}
+	if cfg.Gossip.enabled() {
+		creds, err := clientCredentials(cfg.TLS)
+		if err != nil {
+			fatal("Failed to load TLS credentials", "error", err)
+		}
+		node.gossip = newMembership(cfg.Node.Name, cfg.Gossip, creds)
+	}
+	// Only the maps we sync are reported by the kernel.
+	if _, err := node.applyConfig(cfg); err != nil {
+		fatal("Invalid config", "error", err)
+	}
+	if cfg.Raft.enabled() {
+		creds, err := clientCredentials(cfg.TLS)
+		if err != nil {
+			fatal("Failed to load TLS credentials", "error", err)
+		}
+		node.raft, err = newRaft(cfg.Node.Name, cfg.Raft, creds, raftOptions{
+			apply:    node.raftApply,
+			snapshot: node.raftMaps.snapshot,
+			restore:  node.raftRestore,
+		})
+		if err != nil {
+			fatal("Failed to open the Raft log", "error", err)
+		}
+		// Proposals wait for the previous ones to be committed, and changes
+		// made meanwhile go in the next batch.
+		node.proposer = newBatcher(0, maxAppendEntries, node.proposeChanges)
+		go node.proposer.run()
+		go node.raft.run()
+	}
+	defer func() {
+		for _, p := range node.peers {
+			p.Stop()
+		}
+	}()
+	go node.reloadOnSIGHUP()
+	go node.followPins(cfg.Pins.CheckInterval)
+	go node.expireEntries()
+	go node.resendEntries()
+	if err := node.discover(cfg.Discovery); err != nil {
+		fatal("Invalid config", "error", err)
+	}
+	if node.gossip != nil {
+		node.rebalance(node.gossip.live())
+		go node.followMembers()
+		go node.gossip.run()
 	}
 
 	// Spawn the gRPC server to listen for eBPF map updates from neighbours.
-	go startServer(&Node{syncObjs: syncObjs}, ":"+fmt.Sprint(*serverPort))
+	go startServer(node)
 
 	rd, err := ringbuf.NewReader(syncObjs.MapEvents)
 	if err != nil {
@@ -124,48 +478,13 @@ func main() {
 	}
 	defer rd.Close()
 
-	var avg float32 = 0
 	for {
 		record, err := rd.Read()
 		if err != nil {
 			panic(err)
 		}
 
-		start := time.Now()
 		Event := (*MapData)(unsafe.Pointer(&record.RawSample[0]))
-
-		if debug {
-			log.Printf("Map ID: %d", Event.MapID)
-			log.Printf("Name: %s", string(Event.Name[:]))
-			log.Printf("PID: %d", Event.PID)
-			log.Printf("Update Type: %s", Event.UpdateType.String())
-			log.Printf("Key: %d", Event.Key)
-			log.Printf("Key Size: %d", Event.KeySize)
-			log.Printf("Value: %d", Event.Value)
-			log.Printf("Value Size: %d", Event.ValueSize)
-		}
-
-		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			log.Fatalf("Failed to connect to peer: %v", err)
-			continue
-		}
-		client := NewSyncServiceClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
-		_, err = client.SetValue(ctx, &ValueRequest{Key: int32(Event.Key), Value: int32(Event.Value), Type: int32(Event.UpdateType), Mapid: int32(Event.MapID)})
-		if err != nil {
-			log.Printf("Could not set value on peer: %v", err)
-		}
-		end := time.Since(start)
-
-		if avg != 0 {
-			avg = (avg + float32(end.Milliseconds())) / float32(2)
-		} else {
-			avg = float32(end.Milliseconds())
-		}
-		if debug {
-			log.Printf("Average time taken: %f ms", avg)
-			log.Println("=====================================")
-		}
+		node.localChange(Event)
 	}
 }
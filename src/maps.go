@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// Name of the map loaded by map-sync itself.
+const ownMapName = "hash_map"
+
+// syncedMap is a map replicated by this node.
+type syncedMap struct {
+	cfg    MapConfig
+	m      *ebpf.Map
+	id     ebpf.MapID
+	layout *mapLayout
+	// Opened from bpffs, so m is ours to close.
+	pinned bool
+	// The ID peers refer to the map by, see mapRegistry.
+	ref uint32
+	// Decide which local changes are sent to peers.
+	filters []filterRule
+	// Rewrite changes from peers.
+	transforms []Transform
+}
+
+// resolveMaps finds the maps named in cfg, opening the pinned ones.
+func resolveMaps(cfg *Config, objs *syncObjects) (maps map[string]*syncedMap, err error) {
+	known := map[string]*ebpf.Map{ownMapName: objs.HashMap}
+
+	maps = make(map[string]*syncedMap, len(cfg.Maps))
+	defer func() {
+		if err != nil {
+			closeMaps(maps)
+		}
+	}()
+	for i, mc := range cfg.Maps {
+		field := fmt.Sprintf("maps[%d]", i)
+		m, ok := known[mc.Name]
+		if mc.Pin != "" {
+			if m, err = ebpf.LoadPinnedMap(mc.Pin, nil); err != nil {
+				return maps, fieldErrorf(field+".pin", "%v", err)
+			}
+			maps[mc.Name] = &syncedMap{cfg: mc, m: m, pinned: true}
+		} else if !ok {
+			return maps, fieldErrorf(field+".name", "no map named %s is loaded by map-sync", mc.Name)
+		}
+		if err := checkSchema(mc, m); err != nil {
+			return maps, fieldErrorf(field, "map %s: %v", mc.Name, err)
+		}
+		info, err := m.Info()
+		if err != nil {
+			return maps, err
+		}
+		id, _ := info.ID()
+		layout, err := loadMapLayout(m)
+		if err != nil {
+			slog.Warn("Can't read the BTF of a map, printing its keys and values as hex", "map", mc.Name, "error", err)
+		}
+		var filters []filterRule
+		for j, r := range mc.Filters {
+			f, err := compileFilter(r, layout)
+			if err == nil && mc.KernelFilters {
+				_, err = f.kernel()
+			}
+			if err != nil {
+				return maps, fieldErrorf(fmt.Sprintf("%s.filters[%d]", field, j), "%v", err)
+			}
+			filters = append(filters, f)
+		}
+		var transforms []Transform
+		for j, tc := range mc.Transforms {
+			t, err := newTransform(tc, layout)
+			if err != nil {
+				return maps, fieldErrorf(fmt.Sprintf("%s.transforms[%d]", field, j), "%v", err)
+			}
+			transforms = append(transforms, t)
+		}
+		maps[mc.Name] = &syncedMap{cfg: mc, m: m, id: id, layout: layout, pinned: mc.Pin != "", filters: filters, transforms: transforms}
+	}
+	return maps, nil
+}
+
+// checkSchema checks that m is what mc expects, and that its changes can be
+// reported by the kernel side.
+func checkSchema(mc MapConfig, m *ebpf.Map) error {
+	if mc.Type != "" && !strings.EqualFold(mc.Type, m.Type().String()) {
+		return fmt.Errorf("is a %s, expected a %s", m.Type(), mc.Type)
+	}
+	if mc.KeySize != 0 && mc.KeySize != m.KeySize() {
+		return fmt.Errorf("has %d byte keys, expected %d", m.KeySize(), mc.KeySize)
+	}
+	if mc.ValueSize != 0 && mc.ValueSize != m.ValueSize() {
+		return fmt.Errorf("has %d byte values, expected %d", m.ValueSize(), mc.ValueSize)
+	}
+	if m.KeySize() > MAX_KEY_SIZE || m.ValueSize() > MAX_VALUE_SIZE {
+		return fmt.Errorf("has %d byte keys and %d byte values, at most %d and %d are supported",
+			m.KeySize(), m.ValueSize(), MAX_KEY_SIZE, MAX_VALUE_SIZE)
+	}
+	// Only changes to hash maps are traced, see bpf/sync.c.
+	if mc.sends() && m.Type() != ebpf.Hash {
+		return fmt.Errorf("is a %s, only changes to Hash maps can be sent to peers", m.Type())
+	}
+	return nil
+}
+
+// closeMaps closes the pinned maps we opened.
+func closeMaps(maps map[string]*syncedMap) {
+	for _, sm := range maps {
+		if sm.pinned {
+			sm.m.Close()
+		}
+	}
+}
+
+// pinnedMapID returns the ID of the map currently pinned at path.
+func pinnedMapID(path string) (ebpf.MapID, error) {
+	m, err := ebpf.LoadPinnedMap(path, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+	info, err := m.Info()
+	if err != nil {
+		return 0, err
+	}
+	id, _ := info.ID()
+	return id, nil
+}
+
+// allowMaps fills the in-kernel allowlist with the maps whose local changes
+// are sent to peers.
+func allowMaps(allowlist *ebpf.Map, maps map[string]*syncedMap) error {
+	var one uint8 = 1
+	for _, sm := range maps {
+		if !sm.cfg.sends() {
+			continue
+		}
+		id := uint32(sm.id)
+		if err := allowlist.Update(&id, &one, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("allowing map %s: %w", sm.cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// resyncRequests returns an update request for every entry of the maps whose
+// local changes are sent to peers.
+func resyncRequests(maps map[string]*syncedMap, origin string) ([]*ValueRequest, error) {
+	var reqs []*ValueRequest
+	for name, sm := range maps {
+		// Raft maps are caught up by the Raft log.
+		if !sm.cfg.sends() || sm.cfg.raft() {
+			continue
+		}
+		ms, err := snapshotOf(name, sm.m)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ms.GetEntries() {
+			if sm.replicates(MAP_UPDATE, e.GetKey(), e.GetValue()) {
+				reqs = append(reqs, newValueRequest(sm, MAP_UPDATE, e.GetKey(), e.GetValue(), origin))
+			}
+		}
+	}
+	return reqs, nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// States of a member. At the same incarnation, a later state overrides an
+// earlier one.
+type memberState uint32
+
+const (
+	MEMBER_ALIVE memberState = iota
+	MEMBER_SUSPECT
+	MEMBER_DEAD
+)
+
+func (s memberState) String() string {
+	switch s {
+	case MEMBER_ALIVE:
+		return "alive"
+	case MEMBER_SUSPECT:
+		return "suspect"
+	case MEMBER_DEAD:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// Most updates piggybacked on a message.
+	maxPiggyback = 16
+	// Every update is sent retransmitMult * log(members) times.
+	retransmitMult = 3
+	// Dead members are remembered for this many suspicion timeouts, so stale
+	// updates don't bring them back.
+	deadRetention = 10
+	// Seeds are contacted again every this many probes, so a partitioned
+	// cluster merges again once the partition heals.
+	rejoinProbes = 30
+)
+
+// membership implements SWIM: every interval a member is probed, through
+// other members if it doesn't answer, and suspected if that fails too. A
+// suspected member refutes it by raising its incarnation, or is declared dead
+// after the suspicion timeout. Updates spread by being piggybacked on probes.
+type membership struct {
+	cfg   GossipConfig
+	creds grpc.DialOption
+	// Signaled when the set of live members changed.
+	changed chan struct{}
+
+	mu      sync.Mutex
+	self    *Member
+	members map[string]*member // By node name, without ourselves
+	updates []*update          // Waiting to be piggybacked
+	order   []string           // Members left to probe this round
+	conns   map[string]*grpc.ClientConn
+}
+
+type member struct {
+	*Member
+	since time.Time // Of the last state change
+}
+
+type update struct {
+	m    *Member
+	left int // Transmissions left
+}
+
+func newMembership(name string, cfg GossipConfig, creds grpc.DialOption) *membership {
+	m := &membership{
+		cfg:     cfg,
+		creds:   creds,
+		changed: make(chan struct{}, 1),
+		self:    &Member{Node: name, Address: cfg.Advertise},
+		members: make(map[string]*member),
+		conns:   make(map[string]*grpc.ClientConn),
+	}
+	for _, s := range []memberState{MEMBER_ALIVE, MEMBER_SUSPECT, MEMBER_DEAD} {
+		clusterMembers.Set(s.String(), expvar.Func(func() any { return m.count(s) }))
+	}
+	return m
+}
+
+// run probes members until the process exits.
+func (m *membership) run() {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		m.expire()
+		if m.count(MEMBER_ALIVE)+m.count(MEMBER_SUSPECT) == 0 || i%rejoinProbes == 0 {
+			m.join()
+		} else {
+			m.probe()
+		}
+		<-ticker.C
+	}
+}
+
+// join exchanges the full state with the first seed that answers.
+func (m *membership) join() {
+	seeds := rand.Perm(len(m.cfg.Seeds))
+	for _, i := range seeds {
+		seed := m.cfg.Seeds[i]
+		if seed == m.cfg.Advertise {
+			continue
+		}
+		c, err := m.client(seed)
+		if err != nil {
+			membershipLog.Warn("Can't reach seed", "seed", seed, "error", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.cfg.ProbeTimeout)
+		resp, err := c.Gossip(ctx, &GossipMessage{From: m.me(), Updates: m.state(), Join: true})
+		cancel()
+		if err != nil {
+			membershipLog.Debug("Seed did not answer", "seed", seed, "error", err)
+			continue
+		}
+		m.receive(resp)
+		membershipLog.Debug("Joined the cluster", "seed", seed, "members", len(resp.GetUpdates()))
+		return
+	}
+	if len(seeds) > 0 {
+		membershipLog.Warn("No seed answered", "seeds", m.cfg.Seeds)
+	}
+}
+
+// probe checks the next member, directly and then through others.
+func (m *membership) probe() {
+	target := m.next()
+	if target == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.ProbeTimeout)
+	defer cancel()
+	err := m.ping(ctx, target.GetAddress())
+	if err == nil {
+		return
+	}
+	membershipLog.Debug("Member did not answer, probing it through others", "member", target.GetNode(), "error", err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), m.cfg.ProbeTimeout)
+	defer cancel()
+	helpers := m.pick(m.cfg.IndirectProbes, target.GetNode())
+	acks := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(addr string) {
+			c, err := m.client(addr)
+			if err != nil {
+				acks <- false
+				return
+			}
+			resp, err := c.PingReq(ctx, &PingRequest{From: m.me(), Target: target.GetAddress()})
+			if err == nil {
+				m.receive(resp)
+			}
+			acks <- err == nil
+		}(h.GetAddress())
+	}
+	for range helpers {
+		if <-acks {
+			return
+		}
+	}
+	m.suspect(target)
+}
+
+// ping probes the node at addr directly.
+func (m *membership) ping(ctx context.Context, addr string) error {
+	c, err := m.client(addr)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Gossip(ctx, m.message())
+	if err != nil {
+		return err
+	}
+	m.receive(resp)
+	return nil
+}
+
+// receive handles a message from another node, and returns the answer.
+func (m *membership) receive(in *GossipMessage) *GossipMessage {
+	if in.GetFrom() != nil {
+		m.update(in.GetFrom())
+	}
+	for _, u := range in.GetUpdates() {
+		m.update(u)
+	}
+	if in.GetJoin() {
+		return &GossipMessage{From: m.me(), Updates: m.state()}
+	}
+	msg := m.message()
+	if stale := m.newer(in.GetFrom()); stale != nil {
+		// Let the sender refute it, since we no longer probe it.
+		msg.Updates = append(msg.Updates, stale)
+	}
+	return msg
+}
+
+// newer returns what we know about a member if it overrides u.
+func (m *membership) newer(u *Member) *Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mb, ok := m.members[u.GetNode()]; ok && overrides(mb.Member, u) {
+		return proto.Clone(mb.Member).(*Member)
+	}
+	return nil
+}
+
+// pingFor probes a node on behalf of another that couldn't reach it.
+func (m *membership) pingFor(ctx context.Context, in *PingRequest) (*GossipMessage, error) {
+	if in.GetFrom() != nil {
+		m.update(in.GetFrom())
+	}
+	if err := m.ping(ctx, in.GetTarget()); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%s did not answer: %v", in.GetTarget(), err)
+	}
+	return m.message(), nil
+}
+
+// update applies what another node knows about a member.
+func (m *membership) update(u *Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u.GetNode() == m.self.GetNode() {
+		// Also after a restart, when the cluster still knows an incarnation
+		// of ours from before.
+		if u.GetIncarnation() > m.self.GetIncarnation() || memberState(u.GetState()) != MEMBER_ALIVE && u.GetIncarnation() == m.self.GetIncarnation() {
+			m.self.Incarnation = u.GetIncarnation() + 1
+			membershipLog.Info("Refuting stale membership state", "state", memberState(u.GetState()), "incarnation", m.self.GetIncarnation())
+			m.broadcast(m.self)
+		}
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(u.GetAddress()); err != nil {
+		membershipLog.Warn("Ignoring member with a malformed address", "member", u.GetNode(), "address", u.GetAddress(), "error", err)
+		return
+	}
+	old, ok := m.members[u.GetNode()]
+	switch {
+	case !ok && memberState(u.GetState()) == MEMBER_DEAD:
+		// Nothing to forget.
+		return
+	case !ok:
+		membershipLog.Info("Member joined", "member", u.GetNode(), "address", u.GetAddress())
+	case !overrides(u, old.Member):
+		return
+	default:
+		membershipLog.Info("Member changed", "member", u.GetNode(), "address", u.GetAddress(), "state", memberState(u.GetState()), "incarnation", u.GetIncarnation())
+	}
+	m.members[u.GetNode()] = &member{Member: proto.Clone(u).(*Member), since: time.Now()}
+	m.broadcast(u)
+	wasDead := ok && memberState(old.GetState()) == MEMBER_DEAD
+	if !ok || old.GetAddress() != u.GetAddress() || wasDead != (memberState(u.GetState()) == MEMBER_DEAD) {
+		wake(m.changed)
+	}
+}
+
+// overrides reports whether u is newer than what we know about the member.
+// Only the member itself raises its incarnation.
+func overrides(u, old *Member) bool {
+	if u.GetIncarnation() != old.GetIncarnation() {
+		return u.GetIncarnation() > old.GetIncarnation()
+	}
+	return u.GetState() > old.GetState()
+}
+
+// suspect starts the suspicion timeout of a member that didn't answer.
+func (m *membership) suspect(target *Member) {
+	u := proto.Clone(target).(*Member)
+	u.State = uint32(MEMBER_SUSPECT)
+	m.update(u)
+}
+
+// expire declares suspected members dead once their timeout is up, and
+// forgets members that have been dead for long enough.
+func (m *membership) expire() {
+	m.mu.Lock()
+	var dead []*Member
+	for name, mb := range m.members {
+		switch memberState(mb.GetState()) {
+		case MEMBER_SUSPECT:
+			if time.Since(mb.since) >= m.cfg.SuspicionTimeout {
+				u := proto.Clone(mb.Member).(*Member)
+				u.State = uint32(MEMBER_DEAD)
+				dead = append(dead, u)
+			}
+		case MEMBER_DEAD:
+			if time.Since(mb.since) >= deadRetention*m.cfg.SuspicionTimeout {
+				delete(m.members, name)
+				if conn, ok := m.conns[mb.GetAddress()]; ok {
+					conn.Close()
+					delete(m.conns, mb.GetAddress())
+				}
+			}
+		}
+	}
+	m.mu.Unlock()
+	for _, u := range dead {
+		m.update(u)
+	}
+}
+
+// broadcast queues an update to be piggybacked on the next messages. Called
+// with mu held.
+func (m *membership) broadcast(u *Member) {
+	m.updates = append(m.updates, &update{
+		m:    proto.Clone(u).(*Member),
+		left: retransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+2)))),
+	})
+}
+
+// message returns a probe, or its answer, with the pending updates.
+func (m *membership) message() *GossipMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg := &GossipMessage{From: proto.Clone(m.self).(*Member)}
+	// Newest first: they supersede older updates of the same member.
+	kept := m.updates[:0]
+	for i := len(m.updates) - 1; i >= 0; i-- {
+		u := m.updates[i]
+		if len(msg.Updates) < maxPiggyback {
+			msg.Updates = append(msg.Updates, u.m)
+			u.left--
+		}
+		if u.left > 0 {
+			kept = append(kept, u)
+		}
+	}
+	// Back to oldest first.
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	clear(m.updates[len(kept):])
+	m.updates = kept
+	return msg
+}
+
+func (m *membership) me() *Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return proto.Clone(m.self).(*Member)
+}
+
+// state returns everything we know about the members.
+func (m *membership) state() []*Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := make([]*Member, 0, len(m.members))
+	for _, mb := range m.members {
+		state = append(state, proto.Clone(mb.Member).(*Member))
+	}
+	return state
+}
+
+// next returns the member to probe, going through all of them in random
+// order every round.
+func (m *membership) next() *Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if len(m.order) == 0 {
+			for name, mb := range m.members {
+				if memberState(mb.GetState()) != MEMBER_DEAD {
+					m.order = append(m.order, name)
+				}
+			}
+			if len(m.order) == 0 {
+				return nil
+			}
+			rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		}
+		name := m.order[0]
+		m.order = m.order[1:]
+		if mb, ok := m.members[name]; ok && memberState(mb.GetState()) != MEMBER_DEAD {
+			return proto.Clone(mb.Member).(*Member)
+		}
+	}
+}
+
+// pick returns up to k random live members other than except.
+func (m *membership) pick(k int, except string) []*Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var live []*Member
+	for name, mb := range m.members {
+		if name != except && memberState(mb.GetState()) == MEMBER_ALIVE {
+			live = append(live, mb.Member)
+		}
+	}
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	return live[:min(k, len(live))]
+}
+
+func (m *membership) count(s memberState) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, mb := range m.members {
+		if memberState(mb.GetState()) == s {
+			n++
+		}
+	}
+	return n
+}
+
+// peers returns the members to replicate to: all but the dead ones.
+func (m *membership) peers() []PeerConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var peers []PeerConfig
+	for _, mb := range m.members {
+		if memberState(mb.GetState()) != MEMBER_DEAD {
+			peers = append(peers, PeerConfig{Address: mb.GetAddress()})
+		}
+	}
+	return peers
+}
+
+// live returns the addresses of the members that aren't dead, by name.
+func (m *membership) live() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	live := make(map[string]string, len(m.members))
+	for name, mb := range m.members {
+		if memberState(mb.GetState()) != MEMBER_DEAD {
+			live[name] = mb.GetAddress()
+		}
+	}
+	return live
+}
+
+// client returns a client for the node at addr, dialed on first use. It
+// fails on malformed addresses, which other members may well announce.
+func (m *membership) client(addr string) (SyncServiceClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn, ok := m.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.NewClient(addr, m.creds); err != nil {
+			return nil, err
+		}
+		m.conns[addr] = conn
+	}
+	return NewSyncServiceClient(conn), nil
+}
+
+func (n *Node) Gossip(ctx context.Context, in *GossipMessage) (*GossipMessage, error) {
+	if n.gossip == nil {
+		return nil, status.Error(codes.Unimplemented, "gossip is disabled")
+	}
+	return n.gossip.receive(in), nil
+}
+
+func (n *Node) PingReq(ctx context.Context, in *PingRequest) (*GossipMessage, error) {
+	if n.gossip == nil {
+		return nil, status.Error(codes.Unimplemented, "gossip is disabled")
+	}
+	return n.gossip.pingFor(ctx, in)
+}
+
+// followMembers starts and stops replicating to members as they join and
+// leave the cluster, moves the ownership of keys with them, and cleans up
+// after the dead ones.
+func (n *Node) followMembers() {
+	live := n.gossip.live()
+	for range n.gossip.changed {
+		n.refreshPeers()
+		// The owners and the dead members come from the same view, so that
+		// the entries of a dead member aren't handed over to it.
+		previous := live
+		live = n.gossip.live()
+		n.rebalance(live)
+		for name := range previous {
+			if _, ok := live[name]; !ok {
+				n.originDied(name)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func newTestMembership(t *testing.T, suspicion time.Duration) *membership {
+	t.Helper()
+	cfg := GossipConfig{Advertise: "10.0.0.1:50051", ProbeTimeout: time.Second, SuspicionTimeout: suspicion}
+	return newMembership("self", cfg, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// memberB is what is known about the member b.
+func memberB(state memberState, incarnation uint64) *Member {
+	return &Member{Node: "b", Address: "10.0.0.2:50051", State: uint32(state), Incarnation: incarnation}
+}
+
+func TestMembershipUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		updates   []*Member
+		wantKnown bool
+		want      memberState
+		wantInc   uint64
+	}{
+		{name: "joined", updates: []*Member{memberB(MEMBER_ALIVE, 0)}, wantKnown: true, want: MEMBER_ALIVE},
+		{name: "unknown dead", updates: []*Member{memberB(MEMBER_DEAD, 0)}},
+		{name: "suspected", updates: []*Member{memberB(MEMBER_ALIVE, 0), memberB(MEMBER_SUSPECT, 0)}, wantKnown: true, want: MEMBER_SUSPECT},
+		{name: "stale alive", updates: []*Member{memberB(MEMBER_SUSPECT, 1), memberB(MEMBER_ALIVE, 1)}, wantKnown: true, want: MEMBER_SUSPECT, wantInc: 1},
+		{name: "refuted", updates: []*Member{memberB(MEMBER_SUSPECT, 1), memberB(MEMBER_ALIVE, 2)}, wantKnown: true, want: MEMBER_ALIVE, wantInc: 2},
+		{name: "dead over suspect", updates: []*Member{memberB(MEMBER_SUSPECT, 1), memberB(MEMBER_DEAD, 1)}, wantKnown: true, want: MEMBER_DEAD, wantInc: 1},
+		{name: "stale suspicion", updates: []*Member{memberB(MEMBER_ALIVE, 3), memberB(MEMBER_SUSPECT, 2)}, wantKnown: true, want: MEMBER_ALIVE, wantInc: 3},
+		{name: "malformed address", updates: []*Member{{Node: "b", Address: "10.0.0.2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMembership(t, time.Minute)
+			for _, u := range tt.updates {
+				m.update(u)
+			}
+			got, ok := m.members["b"]
+			if ok != tt.wantKnown {
+				t.Fatalf("member known %v, want %v", ok, tt.wantKnown)
+			}
+			if !ok {
+				return
+			}
+			if memberState(got.GetState()) != tt.want || got.GetIncarnation() != tt.wantInc {
+				t.Errorf("member %s at incarnation %d, want %s at %d", memberState(got.GetState()), got.GetIncarnation(), tt.want, tt.wantInc)
+			}
+		})
+	}
+}
+
+func TestMembershipRefutesSuspicion(t *testing.T) {
+	m := newTestMembership(t, time.Minute)
+	m.update(&Member{Node: "self", Address: "10.0.0.1:50051", State: uint32(MEMBER_SUSPECT)})
+	if inc := m.me().GetIncarnation(); inc != 1 {
+		t.Fatalf("incarnation %d after being suspected, want 1", inc)
+	}
+	// What is known from before a restart is refuted too.
+	m.update(&Member{Node: "self", Address: "10.0.0.1:50051", Incarnation: 5})
+	if inc := m.me().GetIncarnation(); inc != 6 {
+		t.Fatalf("incarnation %d after a newer alive one, want 6", inc)
+	}
+	var refuted bool
+	for _, u := range m.message().GetUpdates() {
+		refuted = refuted || u.GetNode() == "self" && u.GetIncarnation() == 6
+	}
+	if !refuted {
+		t.Error("refutation not gossiped")
+	}
+}
+
+func TestMembershipExpire(t *testing.T) {
+	m := newTestMembership(t, 10*time.Millisecond)
+	m.update(memberB(MEMBER_ALIVE, 0))
+	m.suspect(memberB(MEMBER_ALIVE, 0))
+	m.expire()
+	if s := memberState(m.members["b"].GetState()); s != MEMBER_SUSPECT {
+		t.Fatalf("member %s before the suspicion timeout, want suspect", s)
+	}
+	time.Sleep(20 * time.Millisecond)
+	m.expire()
+	if s := memberState(m.members["b"].GetState()); s != MEMBER_DEAD {
+		t.Fatalf("member %s after the suspicion timeout, want dead", s)
+	}
+	if _, ok := m.live()["b"]; ok {
+		t.Error("dead member still live")
+	}
+}
+
+func TestMembershipPingMalformedAddress(t *testing.T) {
+	m := newTestMembership(t, time.Minute)
+	if err := m.ping(context.Background(), "bad\x00address"); err == nil {
+		t.Error("pinging a malformed address succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+)
+
+// Counters are published through expvar under /debug/vars.
+var (
+	applyErrors  = expvar.NewMap("apply_errors")  // by gRPC code, on the receiving side
+	sendErrors   = expvar.NewMap("send_errors")   // by gRPC code, on the sending side
+	watchClients = expvar.NewInt("watch_clients") // Watch RPC streams
+	attachMode   = expvar.NewString("attach")     // How changes of hash maps are reported: fentry or kprobe
+
+	coalescedChanges = expvar.NewInt("coalesced_changes") // Local changes superseded by a later one to the same key before being sent
+	clusterMembers   = expvar.NewMap("members")           // Members known through gossip, by state
+	discoveredPeers  = expvar.NewMap("discovered_peers")  // By index and type of the discovery config
+	raftStatus       = expvar.NewMap("raft")              // Role, term, leader and log indexes of this Raft member
+	rebalances       = expvar.NewInt("rebalances")        // Times the owners of keys were reassigned as members came and went
+	originEntries    = expvar.NewMap("origin_entries")    // Entries from peers in maps tracking their origin, by origin
+
+	// Per peer address
+	queueDepth     = expvar.NewMap("queue_depth")
+	queueOverflows = expvar.NewMap("queue_overflows")
+	sendRetries    = expvar.NewMap("send_retries")
+	resyncs        = expvar.NewMap("resyncs")
+	batchesSent    = expvar.NewMap("batches_sent")
+	batchedChanges = expvar.NewMap("batched_changes") // Changes sent in batches
+
+	// Per peer address, and "server" for everything received
+	payloadBytes     = expvar.NewMap("payload_bytes")     // Messages before compression
+	compressedBytes  = expvar.NewMap("compressed_bytes")  // Messages after compression
+	compressionRatio = expvar.NewMap("compression_ratio") // payload_bytes / compressed_bytes
+
+	// Per map
+	schemaMismatches = expvar.NewMap("schema_mismatches") // Handshakes refusing to replicate the map
+	raftConflicts    = expvar.NewMap("raft_conflicts")    // Local changes rolled back, having conflicted or failed to commit
+	forwardedChanges = expvar.NewMap("forwarded_changes") // Local changes of keys owned by another node, sent to the owner
+	rejectedChanges  = expvar.NewMap("rejected_changes")  // Local changes of keys owned by another node, not sent
+	filteredChanges  = expvar.NewMap("filtered_changes")  // Local changes kept local by filters, besides those skipped in the kernel
+	expiredEntries   = expvar.NewMap("expired_entries")   // Entries from peers deleted for not being refreshed within the TTL
+	resentEntries    = expvar.NewMap("resent_entries")    // Own entries sent again so that peers don't expire them
+	purgedEntries    = expvar.NewMap("purged_entries")    // Entries deleted as their origin died
+	// Entries given a new origin as theirs died
+	reassignedEntries = expvar.NewMap("reassigned_entries")
+)
+
+func startMetricsServer(addr string) {
+	slog.Info("Metrics are served at /debug/vars", "address", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		fatal("Failed to serve metrics", "error", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// origins tracks which peer each entry of maps with a TTL or a dead_origin
+// policy came from, and when it last sent it, oldest first, so the expired
+// ones are found without going through the others.
+type origins struct {
+	mu   sync.Mutex
+	maps map[string]*refreshes // By map name
+}
+
+type refreshes struct {
+	order *list.List               // Of *refresh, oldest first
+	byKey map[string]*list.Element // Into order
+}
+
+type refresh struct {
+	key    string
+	origin string
+	at     time.Time
+}
+
+func newOrigins() *origins {
+	return &origins{maps: make(map[string]*refreshes)}
+}
+
+// refresh records that origin just sent key.
+func (o *origins) refresh(mapName string, key []byte, origin string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r, ok := o.maps[mapName]
+	if !ok {
+		r = &refreshes{order: list.New(), byKey: make(map[string]*list.Element)}
+		o.maps[mapName] = r
+	}
+	if el, ok := r.byKey[string(key)]; ok {
+		originEntries.Add(el.Value.(*refresh).origin, -1)
+		originEntries.Add(origin, 1)
+		el.Value = &refresh{key: string(key), origin: origin, at: time.Now()}
+		r.order.MoveToBack(el)
+		return
+	}
+	originEntries.Add(origin, 1)
+	r.byKey[string(key)] = r.order.PushBack(&refresh{key: string(key), origin: origin, at: time.Now()})
+}
+
+// tracked reports whether key came from a peer.
+func (o *origins) tracked(mapName string, key []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r, ok := o.maps[mapName]
+	if !ok {
+		return false
+	}
+	_, ok = r.byKey[string(key)]
+	return ok
+}
+
+// forget stops tracking key, deleted or changed locally.
+func (o *origins) forget(mapName string, key []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if r, ok := o.maps[mapName]; ok {
+		if el, ok := r.byKey[string(key)]; ok {
+			r.remove(el)
+		}
+	}
+}
+
+// drop stops tracking the entries of a map. Called with mu held.
+func (o *origins) drop(mapName string) {
+	for _, el := range o.maps[mapName].byKey {
+		originEntries.Add(el.Value.(*refresh).origin, -1)
+	}
+	delete(o.maps, mapName)
+}
+
+func (r *refreshes) remove(el *list.Element) {
+	rf := el.Value.(*refresh)
+	originEntries.Add(rf.origin, -1)
+	r.order.Remove(el)
+	delete(r.byKey, rf.key)
+}
+
+// originDied applies the dead_origin policy of every map to the entries the
+// dead member sent.
+func (n *Node) originDied(dead string) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	n.origins.mu.Lock()
+	defer n.origins.mu.Unlock()
+	self := n.name
+	for name, r := range n.origins.maps {
+		sm, ok := n.maps[name]
+		if !ok || !sm.cfg.tracksOrigins() {
+			n.origins.drop(name)
+			continue
+		}
+		if sm.cfg.DeadOrigin == "" || sm.cfg.DeadOrigin == DEAD_ORIGIN_KEEP {
+			continue
+		}
+		purged, reassigned := 0, 0
+		for key, el := range r.byKey {
+			if el.Value.(*refresh).origin != dead {
+				continue
+			}
+			if sm.cfg.DeadOrigin == DEAD_ORIGIN_PURGE {
+				r.remove(el)
+				if n.purge(sm, []byte(key), dead) {
+					purged++
+				}
+				continue
+			}
+			// Every node picks the same new origin for the entry: its owner
+			// among the live members, which sends it again as its own.
+			owner, _ := n.owner([]byte(key))
+			reassigned++
+			if owner != self {
+				originEntries.Add(dead, -1)
+				originEntries.Add(owner, 1)
+				el.Value = &refresh{key: key, origin: owner, at: time.Now()}
+				r.order.MoveToBack(el)
+				continue
+			}
+			r.remove(el)
+			n.adopt(sm, []byte(key), dead)
+		}
+		if purged > 0 {
+			purgedEntries.Add(name, int64(purged))
+			membershipLog.Info("Purged entries of a dead member", "map", name, "member", dead, "entries", purged)
+		}
+		if reassigned > 0 {
+			reassignedEntries.Add(name, int64(reassigned))
+			membershipLog.Info("Reassigned entries of a dead member", "map", name, "member", dead, "entries", reassigned)
+		}
+	}
+}
+
+// purge deletes an entry sent by a dead member, and reports whether it was
+// still there. Called with n.mu held.
+func (n *Node) purge(sm *syncedMap, key []byte, dead string) bool {
+	err := sm.m.Delete(key)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return false
+	}
+	if err != nil {
+		membershipLog.Error("Failed to purge entry of a dead member", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "member", dead, "error", err)
+		return false
+	}
+	n.mutated(n.name, sm, MAP_DELETE, key, nil)
+	return true
+}
+
+// adopt makes an entry sent by a dead member this node's own, and sends it to
+// peers with this node as its origin. Called with n.mu held.
+func (n *Node) adopt(sm *syncedMap, key []byte, dead string) {
+	value, err := sm.m.LookupBytes(key)
+	if err != nil {
+		membershipLog.Error("Failed to read entry of a dead member", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "member", dead, "error", err)
+		return
+	}
+	if value == nil || !sm.cfg.sends() || !sm.replicates(MAP_UPDATE, key, value) {
+		return
+	}
+	n.sendToPeers(newValueRequest(sm, MAP_UPDATE, key, value, n.name))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+func originCount(origin string) int64 {
+	v, ok := originEntries.Get(origin).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// trackedOrder returns the tracked entries of a map as key@origin, oldest
+// first, checking that the list and the index agree.
+func trackedOrder(t *testing.T, o *origins, mapName string) []string {
+	t.Helper()
+	r, ok := o.maps[mapName]
+	if !ok {
+		return nil
+	}
+	var order []string
+	for el := r.order.Front(); el != nil; el = el.Next() {
+		rf := el.Value.(*refresh)
+		if r.byKey[rf.key] != el {
+			t.Errorf("index of key %s doesn't point to its refresh", rf.key)
+		}
+		order = append(order, rf.key+"@"+rf.origin)
+	}
+	if len(r.byKey) != len(order) {
+		t.Errorf("%d keys indexed, %d refreshes", len(r.byKey), len(order))
+	}
+	return order
+}
+
+func TestOrigins(t *testing.T) {
+	// Origins of their own per case, the counters are shared.
+	tests := []struct {
+		name       string
+		ops        func(o *origins, b, c string)
+		wantOrder  []string
+		wantCounts [2]int64 // Of b and c
+	}{
+		{
+			name: "refresh",
+			ops: func(o *origins, b, c string) {
+				o.refresh("m", []byte("1"), b)
+				o.refresh("m", []byte("2"), c)
+			},
+			wantOrder:  []string{"1@b", "2@c"},
+			wantCounts: [2]int64{1, 1},
+		},
+		{
+			name: "refresh again moves to the back",
+			ops: func(o *origins, b, c string) {
+				o.refresh("m", []byte("1"), b)
+				o.refresh("m", []byte("2"), b)
+				o.refresh("m", []byte("1"), b)
+			},
+			wantOrder:  []string{"2@b", "1@b"},
+			wantCounts: [2]int64{2, 0},
+		},
+		{
+			name: "refresh from another origin",
+			ops: func(o *origins, b, c string) {
+				o.refresh("m", []byte("1"), b)
+				o.refresh("m", []byte("2"), b)
+				o.refresh("m", []byte("1"), c)
+			},
+			wantOrder:  []string{"2@b", "1@c"},
+			wantCounts: [2]int64{1, 1},
+		},
+		{
+			name: "forget",
+			ops: func(o *origins, b, c string) {
+				o.refresh("m", []byte("1"), b)
+				o.refresh("m", []byte("2"), c)
+				o.forget("m", []byte("1"))
+				o.forget("m", []byte("3"))
+				o.forget("other", []byte("2"))
+			},
+			wantOrder:  []string{"2@c"},
+			wantCounts: [2]int64{0, 1},
+		},
+		{
+			name: "drop",
+			ops: func(o *origins, b, c string) {
+				o.refresh("m", []byte("1"), b)
+				o.refresh("other", []byte("1"), c)
+				o.mu.Lock()
+				o.drop("m")
+				o.mu.Unlock()
+			},
+			wantCounts: [2]int64{0, 1},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, c := fmt.Sprintf("origins-%d-b", i), fmt.Sprintf("origins-%d-c", i)
+			o := newOrigins()
+			tt.ops(o, b, c)
+			names := strings.NewReplacer(b, "b", c, "c")
+			var order []string
+			for _, s := range trackedOrder(t, o, "m") {
+				order = append(order, names.Replace(s))
+			}
+			if !slices.Equal(order, tt.wantOrder) {
+				t.Errorf("tracked %v, want %v", order, tt.wantOrder)
+			}
+			if got := [2]int64{originCount(b), originCount(c)}; got != tt.wantCounts {
+				t.Errorf("origin_entries of b and c %v, want %v", got, tt.wantCounts)
+			}
+			for _, want := range tt.wantOrder {
+				if !o.tracked("m", []byte(want[:1])) {
+					t.Errorf("key %s not tracked", want[:1])
+				}
+			}
+		})
+	}
+}
+
+// newTestMap returns a hash map with one byte keys and values, skipping the
+// test where maps can't be created.
+func newTestMap(t *testing.T) *ebpf.Map {
+	t.Helper()
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 1, ValueSize: 1, MaxEntries: 16})
+	if err != nil {
+		t.Skipf("creating a map: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestOriginDied(t *testing.T) {
+	const dead, alive = "died-b", "died-c"
+	n := &Node{name: "a", maps: make(map[string]*syncedMap), origins: newOrigins()}
+	for _, mc := range []MapConfig{
+		{Name: "purged", DeadOrigin: DEAD_ORIGIN_PURGE},
+		{Name: "reassigned", DeadOrigin: DEAD_ORIGIN_REASSIGN},
+		{Name: "kept", DeadOrigin: DEAD_ORIGIN_KEEP, TTL: time.Hour},
+	} {
+		n.maps[mc.Name] = &syncedMap{cfg: mc, m: newTestMap(t)}
+	}
+	ring := newOwnerRing(map[string]string{"a": "", alive: "10.0.0.3:50051"})
+	n.owners.Store(ring)
+	// One byte keys owned by a and c.
+	var ownedByA, ownedByC []byte
+	for k := byte('0'); k <= '9'; k++ {
+		switch owner, _ := ring.owner([]byte{k}); {
+		case owner == "a" && ownedByA == nil:
+			ownedByA = []byte{k}
+		case owner == alive && ownedByC == nil:
+			ownedByC = []byte{k}
+		}
+	}
+	if ownedByA == nil || ownedByC == nil {
+		t.Fatal("no keys owned by both members")
+	}
+	other := []byte("x")
+	for name, sm := range n.maps {
+		for _, k := range [][]byte{ownedByA, ownedByC, other} {
+			if err := sm.m.Put(k, []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n.origins.refresh(name, ownedByA, dead)
+		n.origins.refresh(name, ownedByC, dead)
+		n.origins.refresh(name, other, alive)
+	}
+	n.origins.refresh("removed", other, dead)
+	deadBefore, aliveBefore := originCount(dead), originCount(alive)
+
+	n.originDied(dead)
+
+	tests := []struct {
+		mapName     string
+		key         []byte
+		wantPresent bool
+		wantOrigin  string // Tracked origin, none if untracked
+	}{
+		{mapName: "purged", key: ownedByA},
+		{mapName: "purged", key: ownedByC},
+		{mapName: "purged", key: other, wantPresent: true, wantOrigin: alive},
+		{mapName: "reassigned", key: ownedByA, wantPresent: true},
+		{mapName: "reassigned", key: ownedByC, wantPresent: true, wantOrigin: alive},
+		{mapName: "reassigned", key: other, wantPresent: true, wantOrigin: alive},
+		{mapName: "kept", key: ownedByA, wantPresent: true, wantOrigin: dead},
+		{mapName: "kept", key: ownedByC, wantPresent: true, wantOrigin: dead},
+	}
+	for _, tt := range tests {
+		value, err := n.maps[tt.mapName].m.LookupBytes(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (value != nil) != tt.wantPresent {
+			t.Errorf("%s key %s present %v, want %v", tt.mapName, tt.key, value != nil, tt.wantPresent)
+		}
+		var origin string
+		if el, ok := n.origins.maps[tt.mapName].byKey[string(tt.key)]; ok {
+			origin = el.Value.(*refresh).origin
+		}
+		if origin != tt.wantOrigin {
+			t.Errorf("%s key %s tracked from %q, want %q", tt.mapName, tt.key, origin, tt.wantOrigin)
+		}
+	}
+	if _, ok := n.origins.maps["removed"]; ok {
+		t.Error("entries of a removed map still tracked")
+	}
+	// Of the 7 entries from the dead member, the 2 of the kept map are left,
+	// and the one reassigned to c moved to it.
+	if got, want := originCount(dead)-deadBefore, int64(-5); got != want {
+		t.Errorf("origin_entries of the dead member changed by %d, want %d", got, want)
+	}
+	if got, want := originCount(alive)-aliveBefore, int64(1); got != want {
+		t.Errorf("origin_entries of c changed by %d, want %d", got, want)
+	}
+	for name := range n.maps {
+		trackedOrder(t, n.origins, name)
+	}
+}
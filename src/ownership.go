@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"sort"
+
+	"github.com/cilium/ebpf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Points every member gets on the ring, evening out how many keys each owns.
+const ringPoints = 128
+
+// ownerRing gives every key of maps with ownership an owner by consistent
+// hashing: members are placed at ringPoints points on a ring of hashes, and a
+// key is owned by the member at the first point at or after the key's hash.
+// A member joining or leaving only moves the keys next to its points. Keys
+// are hashed without their map, so a key has the same owner in every map.
+type ownerRing struct {
+	points  []ringPoint
+	members map[string]string // Addresses by name, empty for ourselves
+}
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+func newOwnerRing(members map[string]string) *ownerRing {
+	r := &ownerRing{members: members}
+	for name := range members {
+		for i := 0; i < ringPoints; i++ {
+			r.points = append(r.points, ringPoint{ringHash(binary.BigEndian.AppendUint32([]byte(name), uint32(i))), name})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		return a.hash < b.hash || a.hash == b.hash && a.member < b.member
+	})
+	return r
+}
+
+// ringHash hashes the same on every node, whatever its architecture.
+func ringHash(b []byte) uint64 {
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// owner returns the name and address of the owner of key.
+func (r *ownerRing) owner(key []byte) (string, string) {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	name := r.points[i].member
+	return name, r.members[name]
+}
+
+// owner returns the name and address of the node owning key, which is this
+// node until it knows the members of the cluster.
+func (n *Node) owner(key []byte) (string, string) {
+	r := n.owners.Load()
+	if r == nil {
+		return n.name, ""
+	}
+	return r.owner(key)
+}
+
+// rebalance gives keys owners among the live members of the cluster, by
+// name with their addresses. The keys this node took over are sent to
+// everyone, so the other replicas converge on its values.
+func (n *Node) rebalance(live map[string]string) {
+	members := maps.Clone(live)
+	members[n.name] = ""
+	old := n.owners.Load()
+	if old != nil && maps.Equal(old.members, members) {
+		return
+	}
+	ring := newOwnerRing(members)
+	n.owners.Store(ring)
+	rebalances.Add(1)
+	membershipLog.Info("Rebalanced key ownership", "members", len(members))
+	if old == nil {
+		return
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	self := n.name
+	for _, sm := range n.maps {
+		if !sm.cfg.owned() {
+			continue
+		}
+		ms, err := snapshotOf(sm.cfg.Name, sm.m)
+		if err != nil {
+			membershipLog.Error("Failed to read map to hand over its keys", "map", sm.cfg.Name, "error", err)
+			continue
+		}
+		taken := 0
+		for _, e := range ms.GetEntries() {
+			now, _ := ring.owner(e.GetKey())
+			before, _ := old.owner(e.GetKey())
+			if now == self && before != self && sm.replicates(MAP_UPDATE, e.GetKey(), e.GetValue()) {
+				n.sendToPeers(newValueRequest(sm, MAP_UPDATE, e.GetKey(), e.GetValue(), self))
+				taken++
+			}
+		}
+		if taken > 0 {
+			membershipLog.Info("Took over the ownership of keys", "map", sm.cfg.Name, "keys", taken)
+		}
+	}
+}
+
+// foreignChange handles a local change of a key owned by another node,
+// according to the ownership policy of its map. Called with n.mu held.
+func (n *Node) foreignChange(sm *syncedMap, req *ValueRequest, owner, addr string) {
+	key := req.GetKeyData()
+	p, ok := n.peers[addr]
+	if !ok {
+		// The owner just joined, and isn't replicated to yet.
+		rejectedChanges.Add(sm.cfg.Name, 1)
+		replicationLog.Warn("Owner of the changed key is not a peer yet, not sending the change", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "owner", owner)
+		return
+	}
+	switch sm.cfg.Ownership {
+	case OWNERSHIP_FORWARD:
+		forwardedChanges.Add(sm.cfg.Name, 1)
+		replicationLog.Debug("Forwarding change to the owner of the key", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "owner", owner)
+		n.mutated(req.GetOrigin(), sm, MapUpdater(req.GetType()), key, req.GetValueData())
+		req.Forwarded = true
+		p.Enqueue(req)
+	case OWNERSHIP_REJECT:
+		rejectedChanges.Add(sm.cfg.Name, 1)
+		replicationLog.Info("Rejected change of a key owned by another node", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "owner", owner)
+		go n.rollbackToOwner(sm.cfg.Name, key, p)
+	}
+}
+
+// rollbackToOwner sets key back to the value its owner, the peer p, has.
+func (n *Node) rollbackToOwner(mapName string, key []byte, p *Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	resp, err := p.client.Lookup(ctx, &LookupRequest{Map: mapName, Key: key})
+	cancel()
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	sm, ok := n.maps[mapName]
+	if !ok {
+		return
+	}
+	if err == nil {
+		if resp.GetFound() {
+			err = sm.m.Update(key, resp.GetValue(), ebpf.UpdateAny)
+		} else if err = sm.m.Delete(key); errors.Is(err, ebpf.ErrKeyNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		replicationLog.Error("Failed to roll back rejected change, keeping it until the owner changes the key", "map", mapName, "key", sm.layout.formatKey(key), "owner", p.address, "error", err)
+		return
+	}
+	replicationLog.Debug("Rolled back rejected change to the owner's value", "map", mapName, "key", sm.layout.formatKey(key), "owner", p.address)
+}
+
+// checkForwarded returns an error if this node doesn't own the key of a
+// change forwarded to it. Nodes may briefly disagree on the owner while the
+// members change, so the sender retries until they agree or it sees that the
+// key moved.
+func (n *Node) checkForwarded(sm *syncedMap, in *ValueRequest) error {
+	if !sm.cfg.owned() {
+		return status.Errorf(codes.InvalidArgument, "map %s has no key ownership", sm.cfg.Name)
+	}
+	key, _ := requestKeyValue(in)
+	if owner, _ := n.owner(key); owner != n.name {
+		return status.Errorf(codes.Aborted, "key %s of map %s is owned by %s", sm.layout.formatKey(key), sm.cfg.Name, owner)
+	}
+	return nil
+}
+
+// checkOwner returns an error if a change of a map with ownership doesn't
+// come from the owner of its key: the node that made it, or the owner sending
+// on a change forwarded to it. Until the members of the cluster are known,
+// changes from anyone are accepted. Like with checkForwarded, the sender
+// retries.
+func (n *Node) checkOwner(sm *syncedMap, in *ValueRequest) error {
+	r := n.owners.Load()
+	if !sm.cfg.owned() || r == nil {
+		return nil
+	}
+	sender := in.GetOwner()
+	if sender == "" {
+		sender = in.GetOrigin()
+	}
+	key, _ := requestKeyValue(in)
+	if owner, _ := r.owner(key); owner != sender {
+		return status.Errorf(codes.Aborted, "key %s of map %s is owned by %s, not %s", sm.layout.formatKey(key), sm.cfg.Name, owner, sender)
+	}
+	return nil
+}
+
+// movedOwner reports whether req, queued for the peer at addr, is no longer
+// to be sent because the owner of its key changed since: a change we sent as
+// the owner once another node owns the key, or one forwarded to the peer once
+// it doesn't. Peers would refuse it for good.
+func (n *Node) movedOwner(req *ValueRequest, addr string) bool {
+	n.mu.RLock()
+	sm, ok := n.maps[req.GetMap()]
+	n.mu.RUnlock()
+	if !ok || !sm.cfg.owned() || n.owners.Load() == nil {
+		return false
+	}
+	key, _ := requestKeyValue(req)
+	owner, ownerAddr := n.owner(key)
+	if req.GetForwarded() {
+		return ownerAddr != addr
+	}
+	return owner != n.name
+}
+
+// ownedOnly drops the changes of keys this node doesn't own from reqs.
+func (n *Node) ownedOnly(reqs []*ValueRequest) []*ValueRequest {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	kept := reqs[:0]
+	for _, req := range reqs {
+		if sm, ok := n.maps[req.GetMap()]; ok && sm.cfg.owned() {
+			if owner, _ := n.owner(req.GetKeyData()); owner != n.name {
+				continue
+			}
+		}
+		kept = append(kept, req)
+	}
+	return kept
+}
+
+func (n *Node) Lookup(ctx context.Context, in *LookupRequest) (*LookupResponse, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	sm, ok := n.maps[in.GetMap()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "map %s is not synchronized by this node", in.GetMap())
+	}
+	value, err := sm.m.LookupBytes(in.GetKey())
+	if err != nil {
+		return nil, applyStatus(err)
+	}
+	return &LookupResponse{Found: value != nil, Value: value}, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"expvar"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	minBackoff  = 100 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+	sendTimeout = time.Second
+)
+
+// Peer replicates local map changes to a single remote node. Changes are
+// queued and sent in order by a background goroutine, retrying with
+// exponential backoff while the peer is unreachable. If the queue overflows
+// or the peer reports that it missed a change, the peer is marked as needing
+// a full resync, which pushes our whole map before the queue is resumed.
+//
+// Before sending, peers exchange Hellos to learn the IDs the other side uses
+// for its maps and check that their schemas match. Changes of maps the peer
+// doesn't accept, or has an incompatible schema for, are not sent.
+type Peer struct {
+	address     string
+	opts        peerOptions
+	conn        *grpc.ClientConn
+	client      SyncServiceClient
+	queue       *outboundQueue
+	needsResync atomic.Bool
+	compression atomic.Value // string, as configured
+	cancel      context.CancelFunc
+	done        chan struct{}
+
+	// What was negotiated in the handshake, only used by the sending
+	// goroutine. remoteMaps holds the map IDs of the peer by name, and is nil
+	// until the handshake is done. They are only valid with the epoch.
+	remoteMaps map[string]uint32
+	epoch      uint64
+	version    uint32
+	caps       map[string]bool
+}
+
+// peerOptions are the settings shared by all peers.
+type peerOptions struct {
+	creds     grpc.DialOption
+	queueSize int
+	// If set, outbound queues are persisted to a file in this directory.
+	queueDir  string
+	batchSize int
+	// Returns the full local state used for a resync.
+	snapshot func() ([]*ValueRequest, error)
+	// Returns what we tell the peer in the handshake.
+	hello func() *Hello
+	// Reports whether a queued change is no longer to be sent to the peer
+	// at the address, as the owner of its key changed.
+	movedOwner func(req *ValueRequest, address string) bool
+}
+
+// newPeer creates a peer for pc.
+func newPeer(pc PeerConfig, opts peerOptions) (*Peer, error) {
+	address := pc.Address
+	var path string
+	if opts.queueDir != "" {
+		path = filepath.Join(opts.queueDir, strings.ReplaceAll(address, ":", "_")+".queue")
+	}
+	queue, err := newOutboundQueue(opts.queueSize, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection is established lazily and re-established by gRPC on failure.
+	conn, err := grpc.NewClient(address, opts.creds, grpc.WithStatsHandler(newPayloadStats(address)))
+	if err != nil {
+		queue.Close()
+		return nil, err
+	}
+
+	p := &Peer{
+		address: address,
+		opts:    opts,
+		conn:    conn,
+		client:  NewSyncServiceClient(conn),
+		queue:   queue,
+	}
+	p.setConfig(pc)
+	switch {
+	case queue.dropped > 0:
+		replicationLog.Warn("Queued changes did not fit the queue, scheduling a resync", "peer", address, "dropped", queue.dropped)
+		p.markResync()
+	case queue.resync:
+		replicationLog.Info("Resuming a resync pending before the restart", "peer", address)
+		p.markResync()
+	}
+	queueDepth.Set(address, expvar.Func(func() any { return queue.len() }))
+	return p, nil
+}
+
+// Enqueue schedules req to be sent to the peer.
+func (p *Peer) Enqueue(req *ValueRequest) {
+	if err := p.queue.push(req); err != nil {
+		// Whatever we drop now is covered by the resync.
+		queueOverflows.Add(p.address, 1)
+		if p.markResync() {
+			replicationLog.Warn("Queue overflowed, scheduling a resync", "peer", p.address, "error", err)
+		}
+	}
+}
+
+// markResync drops the queue in favour of a full resync. It returns false if
+// a resync was already pending.
+func (p *Peer) markResync() bool {
+	if p.needsResync.Swap(true) {
+		return false
+	}
+	p.queue.clearForResync()
+	p.queue.notify()
+	return true
+}
+
+// Start sends queued changes in the background until Stop is called.
+func (p *Peer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel, p.done = cancel, make(chan struct{})
+	go func() {
+		defer close(p.done)
+		p.run(ctx)
+	}()
+}
+
+// Stop waits for the background sender to finish and closes the peer.
+func (p *Peer) Stop() {
+	p.cancel()
+	<-p.done
+	p.Close()
+}
+
+func (p *Peer) run(ctx context.Context) {
+	backoff := minBackoff
+	wait := func() bool {
+		// Add up to 20% jitter so peers recovering together don't retry in lockstep.
+		d := backoff + time.Duration(rand.Int63n(int64(backoff)/5+1))
+		backoff = min(backoff*2, maxBackoff)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	for ctx.Err() == nil {
+		if p.remoteMaps == nil {
+			if err := p.handshake(ctx); err != nil {
+				replicationLog.Warn("Handshake failed", "peer", p.address, "error", err)
+				if !wait() {
+					return
+				}
+				continue
+			}
+		}
+
+		if p.needsResync.Load() {
+			if err := p.resync(ctx); err != nil {
+				replicationLog.Warn("Resync failed", "peer", p.address, "error", err)
+				if !wait() {
+					return
+				}
+				continue
+			}
+			backoff = minBackoff
+			continue
+		}
+
+		reqs := p.queue.peek(p.batchSize())
+		if len(reqs) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.queue.wakeup:
+			}
+			continue
+		}
+
+		err := p.send(ctx, reqs)
+		outcome := classifySendError(err, batchOp(reqs))
+		if outcome != SEND_OK {
+			sendErrors.Add(status.Code(err).String(), 1)
+			replicationLog.Warn("Could not set value on peer", "peer", p.address, "outcome", outcome, "error", err)
+		}
+		switch outcome {
+		case SEND_RETRY:
+			sendRetries.Add(p.address, 1)
+			// The peer may have restarted or changed its maps in the meantime.
+			p.remoteMaps = nil
+			if !wait() {
+				return
+			}
+			continue
+		case SEND_RESYNC:
+			p.markResync()
+			continue
+		}
+		p.queue.pop(reqs)
+		backoff = minBackoff
+	}
+}
+
+// setConfig applies the settings of pc that can change while the peer runs,
+// and reports whether any did.
+func (p *Peer) setConfig(pc PeerConfig) bool {
+	return p.compression.Swap(pc.Compression) != pc.Compression
+}
+
+// callOptions returns the options of calls sending changes.
+func (p *Peer) callOptions() []grpc.CallOption {
+	compressor := p.compression.Load().(string)
+	if c := compressionCapability(compressor); c != "" && p.caps[c] {
+		return compressorOption(compressor)
+	}
+	return nil
+}
+
+// batchSize returns how many changes can be sent to the peer at once.
+func (p *Peer) batchSize() int {
+	if p.caps[CAP_BATCH] {
+		return p.opts.batchSize
+	}
+	return 1
+}
+
+// batchOp returns the operation to classify an error sending reqs by. A
+// batch is classified like an update, the peer already ignored deletes of
+// missing keys.
+func batchOp(reqs []*ValueRequest) MapUpdater {
+	if len(reqs) == 1 {
+		return MapUpdater(reqs[0].GetType())
+	}
+	return MAP_UPDATE
+}
+
+// handshake learns the IDs of the peer's maps.
+func (p *Peer) handshake(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	hello := p.opts.hello()
+	resp, err := p.client.Handshake(ctx, hello)
+	if status.Code(err) == codes.Unimplemented {
+		if p.version != 1 {
+			replicationLog.Info("Peer speaks protocol version 1, sending only changes of hash_map", "peer", p.address)
+		}
+		p.version, p.caps, p.remoteMaps = 1, nil, map[string]uint32{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkProtocolVersion(resp.GetProtocolVersion()); err != nil {
+		return err
+	}
+	p.version, p.caps = negotiate(resp)
+	p.epoch = resp.GetEpoch()
+
+	local := make(map[string]*MapRef, len(hello.GetMaps()))
+	for _, m := range hello.GetMaps() {
+		local[m.GetName()] = m
+	}
+	p.remoteMaps = make(map[string]uint32, len(resp.GetMaps()))
+	for _, m := range resp.GetMaps() {
+		if !m.GetAccepts() {
+			continue
+		}
+		if l, ok := local[m.GetName()]; ok && logSchemaMismatch(p.address, l, m) {
+			continue
+		}
+		p.remoteMaps[m.GetName()] = m.GetId()
+	}
+	replicationLog.Debug("Handshake done", "peer", p.address, "node", resp.GetNode(), "version", p.version, "capabilities", resp.GetCapabilities(), "maps", len(p.remoteMaps))
+	return nil
+}
+
+// resync pushes the full local state to the peer.
+func (p *Peer) resync(ctx context.Context) error {
+	// Clear the flag first so changes that overflow while we're pushing
+	// schedule another resync.
+	p.needsResync.Store(false)
+	gen := p.queue.resyncs()
+	reqs, err := p.opts.snapshot()
+	if err == nil {
+		replicationLog.Info("Resyncing peer", "peer", p.address, "entries", len(reqs))
+		for len(reqs) > 0 {
+			batch := reqs[:min(p.batchSize(), len(reqs))]
+			reqs = reqs[len(batch):]
+			err = p.send(ctx, batch)
+			if classifySendError(err, batchOp(batch)) == SEND_RETRY {
+				break
+			}
+			err = nil
+		}
+	}
+	if err != nil {
+		p.needsResync.Store(true)
+		return err
+	}
+	p.queue.resyncDone(gen)
+	resyncs.Add(p.address, 1)
+	return nil
+}
+
+// prepare returns req as it's sent to the peer, or nil if the peer doesn't
+// accept changes of its map.
+func (p *Peer) prepare(req *ValueRequest) *ValueRequest {
+	if req.GetMap() == "" {
+		return req
+	}
+	if p.version == 1 {
+		// Version 1 peers only know hash_map.
+		if req.GetMap() != ownMapName {
+			return nil
+		}
+		return req
+	}
+	ref, ok := p.remoteMaps[req.GetMap()]
+	if !ok {
+		return nil
+	}
+	req = proto.Clone(req).(*ValueRequest)
+	req.MapRef, req.Map, req.Epoch = ref, "", p.epoch
+	if p.caps[CAP_KEY_VALUE_BYTES] {
+		req.Key, req.Value = 0, 0
+	}
+	return req
+}
+
+// send sends reqs to the peer in a single call.
+func (p *Peer) send(ctx context.Context, reqs []*ValueRequest) error {
+	batch := &ValueBatch{Changes: make([]*ValueRequest, 0, len(reqs))}
+	for _, req := range reqs {
+		if p.opts.movedOwner != nil && p.opts.movedOwner(req, p.address) {
+			replicationLog.Debug("Owner of the key changed since the change was queued, not sending", "peer", p.address, "map", req.GetMap())
+			continue
+		}
+		if out := p.prepare(req); out != nil {
+			batch.Changes = append(batch.Changes, out)
+		} else {
+			replicationLog.Debug("Peer doesn't accept changes of map, not sending", "peer", p.address, "map", req.GetMap())
+		}
+	}
+	if len(batch.Changes) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	var err error
+	switch {
+	case len(batch.Changes) > 1:
+		_, err = p.client.SetValues(ctx, batch, p.callOptions()...)
+		batchesSent.Add(p.address, 1)
+		batchedChanges.Add(p.address, int64(len(batch.Changes)))
+	case p.version == 1:
+		err = p.conn.Invoke(ctx, legacySetValueMethod, batch.Changes[0], &Empty{})
+	default:
+		_, err = p.client.SetValue(ctx, batch.Changes[0], p.callOptions()...)
+	}
+	if len(batch.Changes) == 1 {
+		req := batch.Changes[0]
+		replicationLog.Debug("Sent change", "peer", p.address, "map_ref", req.GetMapRef(), "op", MapUpdater(req.GetType()), "key", hex.EncodeToString(req.GetKeyData()), "duration", time.Since(start), "error", err)
+	} else {
+		replicationLog.Debug("Sent changes", "peer", p.address, "changes", len(batch.Changes), "duration", time.Since(start), "error", err)
+	}
+	return err
+}
+
+func (p *Peer) Close() error {
+	p.conn.Close()
+	return p.queue.Close()
+}
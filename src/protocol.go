@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"google.golang.org/grpc"
+)
+
+// Versions of the replication protocol, exchanged in the handshake:
+//
+//	1: SetValue of main.SyncService with 32-bit keys and values, no handshake
+//	2: mapsync.v1.SyncService, handshake, keys and values as bytes, map refs
+//
+// Peers older than minProtocolVersion are refused.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 1
+)
+
+// Optional features, announced in the Hello and used with peers announcing them too.
+const (
+	CAP_KEY_VALUE_BYTES = "key_value_bytes" // Only key_data and value_data are needed in a ValueRequest
+	CAP_BATCH           = "batch"           // SetValues
+)
+
+var capabilities = []string{CAP_KEY_VALUE_BYTES, CAP_BATCH}
+
+func checkProtocolVersion(v uint32) error {
+	if v < minProtocolVersion {
+		return fmt.Errorf("peer speaks protocol version %d, at least %d is required", v, minProtocolVersion)
+	}
+	return nil
+}
+
+// negotiate returns the protocol version and the capabilities both sides support.
+func negotiate(remote *Hello) (uint32, map[string]bool) {
+	caps := make(map[string]bool)
+	for _, c := range remote.GetCapabilities() {
+		if slices.Contains(capabilities, c) {
+			caps[c] = true
+		}
+	}
+	return min(protocolVersion, remote.GetProtocolVersion()), caps
+}
+
+// The service as it was named before the API was versioned, still served and
+// used with peers speaking protocol version 1.
+const (
+	legacyServiceName    = "main.SyncService"
+	legacySetValueMethod = "/" + legacyServiceName + "/SetValue"
+)
+
+var legacyServiceDesc = func() grpc.ServiceDesc {
+	desc := SyncService_ServiceDesc
+	desc.ServiceName = legacyServiceName
+	return desc
+}()
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestCheckProtocolVersion(t *testing.T) {
+	tests := []struct {
+		version uint32
+		wantErr bool
+	}{
+		{version: 0, wantErr: true},
+		{version: minProtocolVersion},
+		{version: protocolVersion},
+		{version: protocolVersion + 1},
+	}
+	for _, tt := range tests {
+		if err := checkProtocolVersion(tt.version); (err != nil) != tt.wantErr {
+			t.Errorf("checkProtocolVersion(%d) = %v, want error %v", tt.version, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hello    *Hello
+		want     uint32
+		wantCaps []string
+	}{
+		{name: "same version", hello: &Hello{ProtocolVersion: protocolVersion, Capabilities: capabilities}, want: protocolVersion, wantCaps: capabilities},
+		{name: "newer peer", hello: &Hello{ProtocolVersion: protocolVersion + 1}, want: protocolVersion},
+		{name: "older peer", hello: &Hello{ProtocolVersion: 1}, want: 1},
+		{name: "unknown capability", hello: &Hello{ProtocolVersion: protocolVersion, Capabilities: []string{"teleport", CAP_BATCH}}, want: protocolVersion, wantCaps: []string{CAP_BATCH}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, caps := negotiate(tt.hello)
+			if version != tt.want {
+				t.Errorf("version %d, want %d", version, tt.want)
+			}
+			if len(caps) != len(tt.wantCaps) {
+				t.Errorf("capabilities %v, want %v", caps, tt.wantCaps)
+			}
+			for _, c := range tt.wantCaps {
+				if !caps[c] {
+					t.Errorf("capabilities %v, want %v", caps, tt.wantCaps)
+				}
+			}
+		})
+	}
+}
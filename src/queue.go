@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+var errQueueFull = errors.New("outbound queue is full")
+
+// outboundQueue is a bounded FIFO of requests waiting to be sent to a peer.
+// When a file is given, every pushed request is also appended to it so a
+// restarted daemon picks up where it left off. The file is rewritten with
+// the requests still queued once most of it was sent, so after a crash some
+// requests may be sent twice, which is harmless since they are replayed in
+// order. A pending resync is recorded next to it, in a file of the same name
+// ending in .resync.
+type outboundQueue struct {
+	mu      sync.Mutex
+	items   []*ValueRequest
+	limit   int
+	path    string
+	file    *os.File
+	records int // In the file
+	popped  int // Records at the start of the file that were sent
+	wakeup  chan struct{}
+	dropped int
+	// A resync was pending when the queue was loaded.
+	resync bool
+	// Bumped whenever a resync is scheduled.
+	resyncGen uint64
+}
+
+func newOutboundQueue(limit int, path string) (*outboundQueue, error) {
+	q := &outboundQueue{
+		limit:  limit,
+		path:   path,
+		wakeup: make(chan struct{}, 1),
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &countingReader{r: bufio.NewReader(f)}
+	for {
+		req := &ValueRequest{}
+		good := r.n
+		err := protodelim.UnmarshalFrom(r, req)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// A torn write at the tail: keep what we could read, and cut it
+			// off so the next requests are appended after the last good one.
+			if err := f.Truncate(good); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("truncating torn queue file: %w", err)
+			}
+			break
+		}
+		q.items = append(q.items, req)
+	}
+	q.records = len(q.items)
+	if len(q.items) > q.limit {
+		q.dropped = len(q.items) - q.limit
+		q.popped = q.dropped
+		q.items = q.items[len(q.items)-q.limit:]
+	}
+	q.file = f
+	if _, err := os.Stat(q.resyncPath()); err == nil {
+		q.resync = true
+	}
+	if len(q.items) > 0 {
+		q.notify()
+	}
+	return q, nil
+}
+
+// countingReader counts the bytes read through it, to know where the last
+// complete record of a file ends.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// push appends a request, returning errQueueFull if the queue is at its limit.
+func (q *outboundQueue) push(req *ValueRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= q.limit {
+		return errQueueFull
+	}
+	if q.file != nil {
+		if _, err := protodelim.MarshalTo(q.file, req); err != nil {
+			return fmt.Errorf("writing queue file: %w", err)
+		}
+		q.records++
+	}
+	q.items = append(q.items, req)
+	q.notify()
+	return nil
+}
+
+// peek returns up to n of the oldest requests without removing them.
+func (q *outboundQueue) peek(n int) []*ValueRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]*ValueRequest(nil), q.items[:min(n, len(q.items))]...)
+}
+
+// pop removes reqs if they are still the oldest requests. They may not be if
+// the queue was cleared since they were peeked.
+func (q *outboundQueue) pop(reqs []*ValueRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(reqs) == 0 || len(q.items) < len(reqs) || q.items[0] != reqs[0] {
+		return
+	}
+	clear(q.items[:len(reqs)])
+	q.items = q.items[len(reqs):]
+	q.popped += len(reqs)
+	switch {
+	case len(q.items) == 0:
+		// Left as is, the file is compacted on a later pop instead.
+		if err := q.truncate(); err != nil {
+			replicationLog.Warn("Failed to truncate queue file", "path", q.path, "error", err)
+		}
+	case q.popped > q.records/2:
+		if err := q.compact(); err != nil {
+			replicationLog.Warn("Failed to compact queue file", "path", q.path, "error", err)
+		}
+	}
+}
+
+// clearForResync drops every queued request in favour of a resync, which is
+// recorded so that it also happens after a restart.
+func (q *outboundQueue) clearForResync() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = nil
+	if err := q.truncate(); err != nil {
+		// The resync recorded below overwrites whatever is replayed.
+		replicationLog.Warn("Failed to truncate queue file", "path", q.path, "error", err)
+	}
+	q.resyncGen++
+	if q.file == nil {
+		return
+	}
+	if err := os.WriteFile(q.resyncPath(), nil, 0o600); err != nil {
+		replicationLog.Warn("Failed to record pending resync", "path", q.resyncPath(), "error", err)
+	}
+}
+
+// resyncs returns what resyncDone needs to tell whether another resync was
+// scheduled in the meantime.
+func (q *outboundQueue) resyncs() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.resyncGen
+}
+
+// resyncDone forgets the pending resync, unless another one was scheduled
+// since resyncs returned gen.
+func (q *outboundQueue) resyncDone(gen uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.resync = false
+	if q.file == nil || q.resyncGen != gen {
+		return
+	}
+	if err := os.Remove(q.resyncPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		replicationLog.Warn("Failed to remove pending resync record", "path", q.resyncPath(), "error", err)
+	}
+}
+
+func (q *outboundQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+// truncate empties the file. Called with mu held.
+func (q *outboundQueue) truncate() error {
+	if q.file != nil {
+		// The file is opened with O_APPEND, so following writes land at the new end.
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+	}
+	q.records, q.popped = 0, 0
+	return nil
+}
+
+// compact rewrites the file with only the requests still queued. Called
+// with mu held.
+func (q *outboundQueue) compact() error {
+	if q.file == nil {
+		return nil
+	}
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, req := range q.items {
+		if _, err = protodelim.MarshalTo(w, req); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	q.file.Close()
+	q.file = f
+	q.records, q.popped = len(q.items), 0
+	return nil
+}
+
+func (q *outboundQueue) resyncPath() string {
+	return q.path + ".resync"
+}
+
+func (q *outboundQueue) notify() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (q *outboundQueue) Close() error {
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func queueKeys(q *outboundQueue) []string {
+	var keys []string
+	for _, req := range q.peek(q.len()) {
+		keys = append(keys, string(req.GetKeyData()))
+	}
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func pushKeys(t *testing.T, q *outboundQueue, keys ...string) {
+	t.Helper()
+	for _, k := range keys {
+		if err := q.push(&ValueRequest{Map: "m", KeyData: []byte(k)}); err != nil {
+			t.Fatalf("push %s: %v", k, err)
+		}
+	}
+}
+
+func reopenQueue(t *testing.T, q *outboundQueue, limit int) *outboundQueue {
+	t.Helper()
+	q.Close()
+	q, err := newOutboundQueue(limit, q.path)
+	if err != nil {
+		t.Fatalf("reopening queue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func newTestQueue(t *testing.T, limit int) *outboundQueue {
+	t.Helper()
+	q, err := newOutboundQueue(limit, filepath.Join(t.TempDir(), "peer.queue"))
+	if err != nil {
+		t.Fatalf("creating queue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestQueueReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		push    []string
+		pop     int
+		want    []string
+		dropped int
+	}{
+		{name: "empty", limit: 10},
+		{name: "queued", limit: 10, push: []string{"a", "b", "c"}, want: []string{"a", "b", "c"}},
+		// Sent requests are sent again until the file is compacted.
+		{name: "popped", limit: 10, push: []string{"a", "b", "c", "d", "e"}, pop: 2, want: []string{"a", "b", "c", "d", "e"}},
+		{name: "compacted", limit: 10, push: []string{"a", "b", "c", "d", "e"}, pop: 3, want: []string{"d", "e"}},
+		{name: "drained", limit: 10, push: []string{"a", "b"}, pop: 2},
+		{name: "at the limit", limit: 2, push: []string{"a", "b"}, want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, tt.limit)
+			pushKeys(t, q, tt.push...)
+			q.pop(q.peek(tt.pop))
+			q = reopenQueue(t, q, tt.limit)
+			if got := queueKeys(q); !equalKeys(got, tt.want) {
+				t.Errorf("reloaded %v, want %v", got, tt.want)
+			}
+			if q.dropped != tt.dropped {
+				t.Errorf("dropped %d, want %d", q.dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestQueueReloadDropsOverLimit(t *testing.T) {
+	q := newTestQueue(t, 10)
+	pushKeys(t, q, "a", "b", "c")
+	q = reopenQueue(t, q, 2)
+	if got, want := queueKeys(q), []string{"b", "c"}; !equalKeys(got, want) {
+		t.Errorf("reloaded %v, want %v", got, want)
+	}
+	if q.dropped != 1 {
+		t.Errorf("dropped %d, want 1", q.dropped)
+	}
+}
+
+func TestQueueTornTail(t *testing.T) {
+	q := newTestQueue(t, 10)
+	pushKeys(t, q, "a", "b")
+	q.Close()
+
+	// Half a record: a length prefix promising more than follows.
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x20, 0x4a})
+	f.Close()
+
+	q, err = newOutboundQueue(10, q.path)
+	if err != nil {
+		t.Fatalf("loading torn queue: %v", err)
+	}
+	if got, want := queueKeys(q), []string{"a", "b"}; !equalKeys(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	pushKeys(t, q, "c")
+	q = reopenQueue(t, q, 10)
+	if got, want := queueKeys(q), []string{"a", "b", "c"}; !equalKeys(got, want) {
+		t.Errorf("changes appended after a torn tail: reloaded %v, want %v", got, want)
+	}
+}
+
+func TestQueueCompaction(t *testing.T) {
+	q := newTestQueue(t, 10)
+	pushKeys(t, q, "a", "b")
+	// Never drains, the file must still stay bounded.
+	for i := 0; i < 1000; i++ {
+		pushKeys(t, q, "c")
+		q.pop(q.peek(1))
+	}
+	if q.records > 2*q.len()+1 {
+		t.Errorf("file holds %d records for %d queued", q.records, q.len())
+	}
+	want := queueKeys(q)
+	q = reopenQueue(t, q, 10)
+	got := queueKeys(q)
+	if len(got) < len(want) || !equalKeys(got[len(got)-len(want):], want) {
+		t.Errorf("reloaded %v after compaction, want it to end with %v", got, want)
+	}
+}
+
+func TestQueueResyncMarker(t *testing.T) {
+	q := newTestQueue(t, 10)
+	pushKeys(t, q, "a")
+	q.clearForResync()
+
+	q = reopenQueue(t, q, 10)
+	if !q.resync {
+		t.Fatal("pending resync lost on restart")
+	}
+	if q.len() != 0 {
+		t.Errorf("%d requests survived the resync", q.len())
+	}
+
+	// Another resync scheduled while one runs keeps the record.
+	gen := q.resyncs()
+	q.clearForResync()
+	q.resyncDone(gen)
+	if _, err := os.Stat(q.resyncPath()); err != nil {
+		t.Errorf("record of the newer resync removed: %v", err)
+	}
+
+	q.resyncDone(q.resyncs())
+	q = reopenQueue(t, q, 10)
+	if q.resync {
+		t.Error("finished resync still pending after a restart")
+	}
+}
+
+func TestQueueTruncateFailure(t *testing.T) {
+	q := newTestQueue(t, 10)
+	pushKeys(t, q, "a", "b")
+
+	// Truncating a file opened read-only fails.
+	f, err := os.Open(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := q.file
+	q.file = f
+	q.pop(q.peek(2))
+	q.file = w
+	f.Close()
+	if q.records != 2 {
+		t.Errorf("file counted with %d records after failing to truncate it, want 2", q.records)
+	}
+
+	// The stale records are compacted away with the next pop.
+	pushKeys(t, q, "c", "d")
+	q.pop(q.peek(1))
+	q = reopenQueue(t, q, 10)
+	if got := queueKeys(q); !equalKeys(got, []string{"d"}) {
+		t.Errorf("reloaded %v, want [d]", got)
+	}
+}
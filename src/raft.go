@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type raftRole int
+
+const (
+	RAFT_FOLLOWER raftRole = iota
+	RAFT_CANDIDATE
+	RAFT_LEADER
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case RAFT_FOLLOWER:
+		return "follower"
+	case RAFT_CANDIDATE:
+		return "candidate"
+	case RAFT_LEADER:
+		return "leader"
+	default:
+		return "unknown"
+	}
+}
+
+// Most entries sent to a member at once.
+const maxAppendEntries = 500
+
+// raftOptions connects a raft to the state its log is applied to.
+type raftOptions struct {
+	// apply applies a committed proposal and reports whether it conflicted.
+	apply func(*Proposal) bool
+	// snapshot returns the state as of the last applied entry, and restore
+	// replaces it.
+	snapshot func() *Snapshot
+	restore  func(*Snapshot)
+}
+
+// raft is a member of a Raft cluster: the members elect a leader, which
+// appends proposals to its log and replicates it to the others. An entry is
+// committed once a majority has it, and then applied in order on every
+// member. The log is compacted into a snapshot of the state once
+// cfg.SnapshotThreshold entries are applied.
+type raft struct {
+	cfg     RaftConfig // As of the start, not changed by a reload
+	id      string
+	members map[string]string // Addresses by name, without ourselves
+	creds   grpc.DialOption
+	opts    raftOptions
+	storage *raftStorage
+	// Signaled when the commit index moved
+	committed chan struct{}
+	// Held while applying entries or restoring a snapshot
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	term     uint64
+	votedFor string
+	snapshot *RaftSnapshot // Covers the log up to snapshot.LastIndex
+	log      []*RaftEntry  // The entries after the snapshot
+	role     raftRole
+	leader   string
+	commit   uint64
+	applied  uint64
+	contact  time.Time     // Last heard from a leader, or voted
+	timeout  time.Duration // Election timeout, randomized every term
+	// Leader state, by member
+	next     map[string]uint64
+	match    map[string]uint64
+	inflight map[string]bool
+	// Proposals of this leader waiting to be applied, by index
+	waiting map[uint64]*raftWaiter
+	clients map[string]SyncServiceClient
+}
+
+type raftWaiter struct {
+	term uint64
+	// Receives whether the proposal conflicted. Closed if another entry
+	// took its place, or if it was only applied as part of a snapshot, which
+	// doesn't tell.
+	result chan bool
+}
+
+func newRaft(id string, cfg RaftConfig, creds grpc.DialOption, opts raftOptions) (*raft, error) {
+	storage, state, snap, entries, err := openRaftStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &raft{
+		cfg:       cfg,
+		id:        id,
+		members:   make(map[string]string),
+		creds:     creds,
+		opts:      opts,
+		storage:   storage,
+		committed: make(chan struct{}, 1),
+		term:      state.Term,
+		votedFor:  state.VotedFor,
+		snapshot:  snap,
+		log:       entries,
+		commit:    snap.GetLastIndex(),
+		applied:   snap.GetLastIndex(),
+		contact:   time.Now(),
+		waiting:   make(map[uint64]*raftWaiter),
+		clients:   make(map[string]SyncServiceClient),
+	}
+	for _, m := range cfg.Members {
+		if m.Name != id {
+			r.members[m.Name] = m.Address
+		}
+	}
+	r.resetTimeout()
+	r.publish()
+	// The log after the snapshot is applied again once the commit index is
+	// known.
+	opts.restore(snap.GetState())
+	raftLog.Info("Raft log loaded", "term", r.term, "snapshot", snap.GetLastIndex(), "last_index", r.lastIndex())
+	return r, nil
+}
+
+// publish registers the status of r as metrics.
+func (r *raft) publish() {
+	status := func(f func() any) expvar.Func {
+		return func() any {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return f()
+		}
+	}
+	raftStatus.Set("role", status(func() any { return r.role.String() }))
+	raftStatus.Set("term", status(func() any { return r.term }))
+	raftStatus.Set("leader", status(func() any { return r.leader }))
+	raftStatus.Set("commit_index", status(func() any { return r.commit }))
+	raftStatus.Set("applied_index", status(func() any { return r.applied }))
+	raftStatus.Set("last_index", status(func() any { return r.lastIndex() }))
+}
+
+// run holds elections and, as the leader, sends heartbeats until the
+// process exits.
+func (r *raft) run() {
+	go r.applyCommitted()
+	for range time.Tick(r.cfg.HeartbeatInterval) {
+		r.mu.Lock()
+		role, expired := r.role, time.Since(r.contact) >= r.timeout
+		r.mu.Unlock()
+		switch {
+		case role == RAFT_LEADER:
+			r.replicate()
+		case expired:
+			r.campaign()
+		}
+	}
+}
+
+func (r *raft) quorum() int {
+	return (len(r.members)+1)/2 + 1
+}
+
+func (r *raft) resetTimeout() {
+	r.contact = time.Now()
+	r.timeout = r.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(r.cfg.ElectionTimeout)))
+}
+
+func (r *raft) lastIndex() uint64 {
+	return r.snapshot.GetLastIndex() + uint64(len(r.log))
+}
+
+// termAt returns the term of the entry at index, 0 if it was compacted.
+func (r *raft) termAt(index uint64) uint64 {
+	switch {
+	case index == r.snapshot.GetLastIndex():
+		return r.snapshot.GetLastTerm()
+	case index < r.snapshot.GetLastIndex() || index > r.lastIndex():
+		return 0
+	default:
+		return r.log[index-r.snapshot.GetLastIndex()-1].GetTerm()
+	}
+}
+
+// entries returns the entries from index on, at most max of them.
+func (r *raft) entries(from uint64, max int) []*RaftEntry {
+	i := from - r.snapshot.GetLastIndex() - 1
+	return append([]*RaftEntry(nil), r.log[i:min(int(i)+max, len(r.log))]...)
+}
+
+// saveState persists the term and vote. Called with mu held.
+func (r *raft) saveState() {
+	if err := r.storage.saveState(raftHardState{Term: r.term, VotedFor: r.votedFor}); err != nil {
+		// Carrying on could mean voting twice in a term.
+		fatal("Failed to save the Raft state", "error", err)
+	}
+}
+
+// stepDown makes us a follower, in term if it's newer. Called with mu held.
+func (r *raft) stepDown(term uint64) {
+	if term > r.term {
+		// The leader we knew was deposed, whoever leads the new term tells
+		// us with its first AppendEntries.
+		r.term, r.votedFor, r.leader = term, "", ""
+		r.saveState()
+	}
+	if r.role != RAFT_FOLLOWER {
+		raftLog.Info("Stepping down", "term", r.term, "role", r.role)
+	}
+	r.role = RAFT_FOLLOWER
+}
+
+// campaign starts an election for the next term.
+func (r *raft) campaign() {
+	r.mu.Lock()
+	r.role = RAFT_CANDIDATE
+	r.term++
+	r.votedFor, r.leader = r.id, ""
+	r.saveState()
+	r.resetTimeout()
+	term := r.term
+	req := &VoteRequest{Term: term, Candidate: r.id, LastLogIndex: r.lastIndex(), LastLogTerm: r.termAt(r.lastIndex())}
+	votes := 1
+	if votes >= r.quorum() {
+		r.lead()
+	}
+	r.mu.Unlock()
+	raftLog.Debug("Starting an election", "term", term)
+
+	for name, addr := range r.members {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), r.cfg.ElectionTimeout)
+			defer cancel()
+			var resp *VoteResponse
+			c, err := r.client(addr)
+			if err == nil {
+				resp, err = c.RequestVote(ctx, req)
+			}
+			if err != nil {
+				raftLog.Debug("Vote request failed", "member", name, "error", err)
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if resp.GetTerm() > r.term {
+				r.stepDown(resp.GetTerm())
+				return
+			}
+			if !resp.GetGranted() || r.role != RAFT_CANDIDATE || r.term != term {
+				return
+			}
+			votes++
+			if votes == r.quorum() {
+				r.lead()
+			}
+		}()
+	}
+}
+
+// lead makes us the leader of the current term. Called with mu held.
+func (r *raft) lead() {
+	raftLog.Info("Elected leader", "term", r.term)
+	r.role, r.leader = RAFT_LEADER, r.id
+	r.next = make(map[string]uint64, len(r.members))
+	r.match = make(map[string]uint64, len(r.members))
+	r.inflight = make(map[string]bool, len(r.members))
+	for name := range r.members {
+		r.next[name] = r.lastIndex() + 1
+	}
+	// Entries of earlier terms are only known to be committed once one of
+	// ours is.
+	r.appendEntries(&RaftEntry{})
+	go r.replicate()
+}
+
+// appendEntries adds entries to the leader's log. Called with mu held.
+func (r *raft) appendEntries(entries ...*RaftEntry) {
+	for _, e := range entries {
+		e.Index, e.Term = r.lastIndex()+1, r.term
+		r.log = append(r.log, e)
+	}
+	if err := r.storage.append(entries); err != nil {
+		fatal("Failed to write the Raft log", "error", err)
+	}
+	r.advanceCommit()
+}
+
+// advanceCommit commits the entries of this term a majority has. Called with
+// mu held.
+func (r *raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commit && r.termAt(n) == r.term; n-- {
+		count := 1
+		for _, m := range r.match {
+			if m >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commit = n
+			wake(r.committed)
+			return
+		}
+	}
+}
+
+// replicate sends the entries members are missing, or a heartbeat.
+func (r *raft) replicate() {
+	for name, addr := range r.members {
+		go r.replicateTo(name, addr)
+	}
+}
+
+func (r *raft) replicateTo(name, addr string) {
+	r.mu.Lock()
+	if r.role != RAFT_LEADER || r.inflight[name] {
+		r.mu.Unlock()
+		return
+	}
+	r.inflight[name] = true
+	term, next := r.term, r.next[name]
+	var send func(context.Context, SyncServiceClient) (*AppendResponse, error)
+	var sent uint64 // Last index sent
+	if next <= r.snapshot.GetLastIndex() {
+		req := &InstallSnapshotRequest{Term: term, Leader: r.id, Snapshot: r.snapshot}
+		sent = r.snapshot.GetLastIndex()
+		send = func(ctx context.Context, c SyncServiceClient) (*AppendResponse, error) {
+			return c.InstallSnapshot(ctx, req)
+		}
+	} else {
+		req := &AppendRequest{
+			Term:         term,
+			Leader:       r.id,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  r.termAt(next - 1),
+			Entries:      r.entries(next, maxAppendEntries),
+			LeaderCommit: r.commit,
+		}
+		sent = next - 1 + uint64(len(req.Entries))
+		send = func(ctx context.Context, c SyncServiceClient) (*AppendResponse, error) {
+			return c.AppendEntries(ctx, req)
+		}
+	}
+	r.mu.Unlock()
+
+	var resp *AppendResponse
+	c, err := r.client(addr)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), r.cfg.ElectionTimeout)
+		resp, err = send(ctx, c)
+		cancel()
+	}
+
+	r.mu.Lock()
+	r.inflight[name] = false
+	if err != nil {
+		// Retried with the next heartbeat.
+		r.mu.Unlock()
+		raftLog.Debug("Replication failed", "member", name, "error", err)
+		return
+	}
+	if resp.GetTerm() > r.term {
+		r.stepDown(resp.GetTerm())
+	}
+	if r.role != RAFT_LEADER || r.term != term {
+		r.mu.Unlock()
+		return
+	}
+	if resp.GetSuccess() {
+		r.match[name] = max(r.match[name], sent)
+		r.next[name] = r.match[name] + 1
+		r.advanceCommit()
+	} else {
+		// Continue from where the member's log ends, or one entry earlier
+		// than this time if it has a conflicting entry there.
+		r.next[name] = max(1, min(next-1, resp.GetLastLogIndex()+1))
+	}
+	more := r.next[name] <= r.lastIndex()
+	r.mu.Unlock()
+	if more {
+		r.replicateTo(name, addr)
+	}
+}
+
+// vote answers a candidate's vote request.
+func (r *raft) vote(req *VoteRequest) *VoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.GetTerm() > r.term {
+		r.stepDown(req.GetTerm())
+	}
+	last := r.lastIndex()
+	upToDate := req.GetLastLogTerm() > r.termAt(last) || req.GetLastLogTerm() == r.termAt(last) && req.GetLastLogIndex() >= last
+	granted := req.GetTerm() == r.term && (r.votedFor == "" || r.votedFor == req.GetCandidate()) && upToDate
+	if granted {
+		r.votedFor = req.GetCandidate()
+		r.saveState()
+		r.resetTimeout()
+		raftLog.Debug("Voted", "term", r.term, "candidate", req.GetCandidate())
+	}
+	return &VoteResponse{Term: r.term, Granted: granted}
+}
+
+// follow handles a message from the leader of term, and reports whether it's
+// current. Called with mu held.
+func (r *raft) follow(term uint64, leader string) bool {
+	if term < r.term {
+		return false
+	}
+	if term > r.term || r.role != RAFT_FOLLOWER {
+		r.stepDown(term)
+	}
+	if r.leader != leader {
+		raftLog.Info("Following leader", "term", term, "leader", leader)
+	}
+	r.leader = leader
+	r.resetTimeout()
+	return true
+}
+
+// append appends the leader's entries that aren't in our log yet.
+func (r *raft) append(req *AppendRequest) *AppendResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.follow(req.GetTerm(), req.GetLeader()) {
+		return &AppendResponse{Term: r.term, LastLogIndex: r.lastIndex()}
+	}
+	prev := req.GetPrevLogIndex()
+	if prev > r.lastIndex() {
+		return &AppendResponse{Term: r.term, LastLogIndex: r.lastIndex()}
+	}
+	if prev > r.snapshot.GetLastIndex() && r.termAt(prev) != req.GetPrevLogTerm() {
+		return &AppendResponse{Term: r.term, LastLogIndex: prev - 1}
+	}
+
+	var added []*RaftEntry
+	truncated := false
+	for _, e := range req.GetEntries() {
+		switch {
+		case e.GetIndex() <= r.snapshot.GetLastIndex():
+			// Committed and compacted, so the same as the leader's.
+			continue
+		case e.GetIndex() <= r.lastIndex():
+			if r.termAt(e.GetIndex()) == e.GetTerm() {
+				continue
+			}
+			// A leader of an earlier term left entries that were never
+			// committed.
+			r.log = r.log[:e.GetIndex()-r.snapshot.GetLastIndex()-1]
+			truncated = true
+		}
+		r.log = append(r.log, e)
+		added = append(added, e)
+	}
+	var err error
+	if truncated {
+		err = r.storage.rewrite(r.log)
+	} else if len(added) > 0 {
+		err = r.storage.append(added)
+	}
+	if err != nil {
+		fatal("Failed to write the Raft log", "error", err)
+	}
+
+	if commit := min(req.GetLeaderCommit(), prev+uint64(len(req.GetEntries()))); commit > r.commit {
+		r.commit = commit
+		wake(r.committed)
+	}
+	return &AppendResponse{Term: r.term, Success: true, LastLogIndex: r.lastIndex()}
+}
+
+// installSnapshot replaces our state with the leader's snapshot, for members
+// that are missing entries the leader already compacted.
+func (r *raft) installSnapshot(req *InstallSnapshotRequest) *AppendResponse {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.follow(req.GetTerm(), req.GetLeader()) {
+		return &AppendResponse{Term: r.term, LastLogIndex: r.lastIndex()}
+	}
+	snap := req.GetSnapshot()
+	if snap.GetLastIndex() <= r.snapshot.GetLastIndex() {
+		return &AppendResponse{Term: r.term, Success: true, LastLogIndex: r.lastIndex()}
+	}
+	// Entries after the snapshot are kept if they agree with it.
+	if r.termAt(snap.GetLastIndex()) == snap.GetLastTerm() {
+		r.log = r.log[snap.GetLastIndex()-r.snapshot.GetLastIndex():]
+	} else {
+		r.log = nil
+	}
+	r.snapshot = snap
+	if err := r.storage.saveSnapshot(snap, r.log); err != nil {
+		fatal("Failed to write the Raft snapshot", "error", err)
+	}
+	r.commit = max(r.commit, snap.GetLastIndex())
+	if r.applied < snap.GetLastIndex() {
+		raftLog.Info("Restoring the leader's snapshot", "last_index", snap.GetLastIndex())
+		r.opts.restore(snap.GetState())
+		r.applied = snap.GetLastIndex()
+	}
+	// Proposals from when we were the leader are never applied on their own.
+	for index, w := range r.waiting {
+		if index <= snap.GetLastIndex() {
+			delete(r.waiting, index)
+			close(w.result)
+		}
+	}
+	return &AppendResponse{Term: r.term, Success: true, LastLogIndex: r.lastIndex()}
+}
+
+// applyCommitted applies committed entries in order as they're committed.
+func (r *raft) applyCommitted() {
+	for range r.committed {
+		r.applyMu.Lock()
+		r.mu.Lock()
+		var entries []*RaftEntry
+		if r.commit > r.applied {
+			entries = r.entries(r.applied+1, int(r.commit-r.applied))
+		}
+		r.mu.Unlock()
+
+		for _, e := range entries {
+			conflict := false
+			if e.GetProposal() != nil {
+				conflict = r.opts.apply(e.GetProposal())
+			}
+			r.mu.Lock()
+			r.applied = e.GetIndex()
+			if w, ok := r.waiting[e.GetIndex()]; ok {
+				delete(r.waiting, e.GetIndex())
+				if w.term == e.GetTerm() {
+					w.result <- conflict
+				} else {
+					close(w.result)
+				}
+			}
+			r.mu.Unlock()
+		}
+		r.compact()
+		r.applyMu.Unlock()
+	}
+}
+
+// compact replaces the applied entries with a snapshot once there are enough
+// of them. Called with applyMu held.
+func (r *raft) compact() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.applied-r.snapshot.GetLastIndex() < uint64(r.cfg.SnapshotThreshold) {
+		return
+	}
+	snap := &RaftSnapshot{LastIndex: r.applied, LastTerm: r.termAt(r.applied), State: r.opts.snapshot()}
+	log := r.log[r.applied-r.snapshot.GetLastIndex():]
+	if err := r.storage.saveSnapshot(snap, log); err != nil {
+		raftLog.Error("Failed to compact the Raft log", "error", err)
+		return
+	}
+	r.snapshot, r.log = snap, append([]*RaftEntry(nil), log...)
+	raftLog.Debug("Compacted the Raft log", "last_index", snap.GetLastIndex())
+}
+
+// propose commits proposals and returns whether each conflicted once
+// applied. Members other than the leader forward them to the leader if
+// forward is set.
+func (r *raft) propose(ctx context.Context, proposals []*Proposal, forward bool) ([]bool, error) {
+	r.mu.Lock()
+	if r.role != RAFT_LEADER {
+		leader := r.leader
+		r.mu.Unlock()
+		addr, ok := r.members[leader]
+		if !forward || !ok {
+			return nil, status.Errorf(codes.Unavailable, "not the Raft leader, the leader is %q", leader)
+		}
+		c, err := r.client(addr)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "can't reach the Raft leader %q: %v", leader, err)
+		}
+		resp, err := c.Propose(ctx, &ProposeRequest{Proposals: proposals})
+		return resp.GetConflicts(), err
+	}
+	entries := make([]*RaftEntry, len(proposals))
+	waiters := make([]*raftWaiter, len(proposals))
+	for i, p := range proposals {
+		entries[i] = &RaftEntry{Proposal: p}
+	}
+	r.appendEntries(entries...)
+	for i, e := range entries {
+		waiters[i] = &raftWaiter{term: e.GetTerm(), result: make(chan bool, 1)}
+		r.waiting[e.GetIndex()] = waiters[i]
+	}
+	r.mu.Unlock()
+	r.replicate()
+
+	conflicts := make([]bool, len(proposals))
+	for i, w := range waiters {
+		select {
+		case conflict, ok := <-w.result:
+			if !ok {
+				return nil, status.Error(codes.Aborted, "lost the Raft leadership before the proposal was applied")
+			}
+			conflicts[i] = conflict
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	return conflicts, nil
+}
+
+// client returns a client for the member at addr, dialed on first use.
+func (r *raft) client(addr string) (SyncServiceClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clients[addr]
+	if !ok {
+		conn, err := grpc.NewClient(addr, r.creds)
+		if err != nil {
+			return nil, err
+		}
+		c = NewSyncServiceClient(conn)
+		r.clients[addr] = c
+	}
+	return c, nil
+}
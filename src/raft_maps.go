@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// raftMaps is the state of the raft maps as of the last applied entry. The
+// local BPF maps follow it: committed changes are written to them, and local
+// changes that fail to commit are rolled back to it.
+//
+// A local change is only known once the kernel made it, so it's proposed on
+// the condition that the key still holds what this node last knew it held.
+// Of two nodes changing a key at the same time, the change committed first
+// wins, the other conflicts and is rolled back.
+type raftMaps struct {
+	mu      sync.Mutex
+	state   map[string]map[string][]byte // By map name, then key
+	pending map[string]*pendingChange    // Local changes being proposed, by map name and key
+}
+
+type pendingChange struct {
+	value []byte // Of the last one, nil for a delete
+	count int
+}
+
+func newRaftMaps() *raftMaps {
+	return &raftMaps{state: make(map[string]map[string][]byte), pending: make(map[string]*pendingChange)}
+}
+
+func pendingKey(mapName string, key []byte) string {
+	return mapName + "\x00" + string(key)
+}
+
+// apply applies a committed proposal to the state, and reports whether it
+// conflicted.
+func (s *raftMaps) apply(p *Proposal) bool {
+	key, value := requestKeyValue(p.GetChange())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.state[p.GetChange().GetMap()]
+	if m == nil {
+		m = make(map[string][]byte)
+		s.state[p.GetChange().GetMap()] = m
+	}
+	if p.GetConditional() && !bytes.Equal(m[string(key)], p.GetExpected()) {
+		return true
+	}
+	if MapUpdater(p.GetChange().GetType()) == MAP_DELETE {
+		delete(m, string(key))
+	} else {
+		m[string(key)] = value
+	}
+	return false
+}
+
+// propose returns the proposal of a local change, conditional on the key
+// holding what it held before, and records it as pending.
+func (s *raftMaps) propose(req *ValueRequest) *Proposal {
+	key, value := requestKeyValue(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := pendingKey(req.GetMap(), key)
+	p := &Proposal{Change: req, Conditional: true, Expected: s.state[req.GetMap()][string(key)]}
+	pc, ok := s.pending[k]
+	if ok {
+		// The key holds what our previous change set, if that commits.
+		p.Expected = pc.value
+	} else {
+		pc = &pendingChange{}
+		s.pending[k] = pc
+	}
+	pc.count++
+	pc.value = nil
+	if MapUpdater(req.GetType()) == MAP_UPDATE {
+		pc.value = value
+	}
+	return p
+}
+
+// done records that a proposed local change was committed or failed, and
+// reports whether it was the last one pending for the key.
+func (s *raftMaps) done(req *ValueRequest) bool {
+	key, _ := requestKeyValue(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := pendingKey(req.GetMap(), key)
+	pc, ok := s.pending[k]
+	if !ok {
+		return true
+	}
+	if pc.count--; pc.count > 0 {
+		return false
+	}
+	delete(s.pending, k)
+	return true
+}
+
+func (s *raftMaps) isPending(mapName string, key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pending[pendingKey(mapName, key)]
+	return ok
+}
+
+// lookup returns the value of key in the state, nil if it's missing.
+func (s *raftMaps) lookup(mapName string, key []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state[mapName][string(key)]
+}
+
+func (s *raftMaps) snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &Snapshot{}
+	for name, m := range s.state {
+		ms := &MapSnapshot{Name: name}
+		for k, v := range m {
+			ms.Entries = append(ms.Entries, &Entry{Key: []byte(k), Value: v})
+		}
+		snap.Maps = append(snap.Maps, ms)
+	}
+	return snap
+}
+
+func (s *raftMaps) restore(snap *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = make(map[string]map[string][]byte, len(snap.GetMaps()))
+	for _, ms := range snap.GetMaps() {
+		m := make(map[string][]byte, len(ms.GetEntries()))
+		for _, e := range ms.GetEntries() {
+			m[string(e.GetKey())] = e.GetValue()
+		}
+		s.state[ms.GetName()] = m
+	}
+}
+
+// entries returns a copy of the state of a map.
+func (s *raftMaps) entries(mapName string) map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string][]byte, len(s.state[mapName]))
+	for k, v := range s.state[mapName] {
+		m[k] = v
+	}
+	return m
+}
+
+// raftApply applies a committed proposal to the state and the local map.
+func (n *Node) raftApply(p *Proposal) bool {
+	if n.raftMaps.apply(p) {
+		return true
+	}
+	req := p.GetChange()
+	key, value := requestKeyValue(req)
+	op := MapUpdater(req.GetType())
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	sm, ok := n.maps[req.GetMap()]
+	if !ok || !sm.cfg.raft() {
+		return false
+	}
+	// A later change of ours to the key is being proposed, and already in
+	// the map.
+	if req.GetOrigin() == n.name && n.raftMaps.isPending(req.GetMap(), key) {
+		n.mutated(req.GetOrigin(), sm, op, key, value)
+		return false
+	}
+	var err error
+	if op == MAP_DELETE {
+		err = sm.m.Delete(key)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			err = nil
+		}
+	} else {
+		err = sm.m.Update(key, value, ebpf.UpdateAny)
+	}
+	if err != nil {
+		// The state and the map now differ, until the next change of the key.
+		applyLog.Error("Failed to apply committed change", "map", sm.cfg.Name, "op", op, "key", sm.layout.formatKey(key), "origin", req.GetOrigin(), "error", err)
+		return false
+	}
+	applyLog.Debug("Applied committed change", "map", sm.cfg.Name, "op", op, "key", sm.layout.formatKey(key), "origin", req.GetOrigin())
+	n.mutated(req.GetOrigin(), sm, op, key, value)
+	return false
+}
+
+// raftRestore replaces the state with a snapshot, and the contents of the
+// local raft maps with the state.
+func (n *Node) raftRestore(snap *Snapshot) {
+	n.raftMaps.restore(snap)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, sm := range n.maps {
+		if sm.cfg.raft() {
+			n.syncRaftMap(sm)
+		}
+	}
+}
+
+// syncRaftMap makes the local map hold the state of the Raft log. Called
+// with n.mu held.
+func (n *Node) syncRaftMap(sm *syncedMap) {
+	want := n.raftMaps.entries(sm.cfg.Name)
+	current, err := snapshotOf(sm.cfg.Name, sm.m)
+	if err != nil {
+		applyLog.Error("Failed to read raft map", "map", sm.cfg.Name, "error", err)
+		return
+	}
+	for _, e := range current.GetEntries() {
+		if _, ok := want[string(e.GetKey())]; !ok {
+			if err := sm.m.Delete(e.GetKey()); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				applyLog.Error("Failed to delete from raft map", "map", sm.cfg.Name, "key", sm.layout.formatKey(e.GetKey()), "error", err)
+			}
+		}
+	}
+	for k, v := range want {
+		if err := sm.m.Update([]byte(k), v, ebpf.UpdateAny); err != nil {
+			applyLog.Error("Failed to update raft map", "map", sm.cfg.Name, "key", sm.layout.formatKey([]byte(k)), "error", err)
+		}
+	}
+	applyLog.Info("Synchronized raft map with the Raft log", "map", sm.cfg.Name, "entries", len(want))
+}
+
+// proposeChanges commits the local changes of raft maps handed over by the
+// batcher, in order, and rolls back those that conflict or fail.
+func (n *Node) proposeChanges(reqs []*ValueRequest) {
+	proposals := make([]*Proposal, len(reqs))
+	for i, req := range reqs {
+		proposals[i] = n.raftMaps.propose(req)
+	}
+	// The Raft settings only change on restart, n.cfg is replaced on reload.
+	ctx, cancel := context.WithTimeout(context.Background(), raftProposalTimeout*n.raft.cfg.ElectionTimeout)
+	conflicts, err := n.raft.propose(ctx, proposals, true)
+	cancel()
+	if err != nil {
+		raftLog.Warn("Failed to commit local changes, rolling them back", "changes", len(reqs), "error", err)
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for i, req := range reqs {
+		failed := err != nil || conflicts[i]
+		if failed {
+			raftConflicts.Add(req.GetMap(), 1)
+		}
+		// Only the outcome of the last change of a key matters, earlier
+		// ones are overwritten by it.
+		if !n.raftMaps.done(req) || !failed {
+			continue
+		}
+		sm, ok := n.maps[req.GetMap()]
+		if !ok {
+			continue
+		}
+		key, _ := requestKeyValue(req)
+		n.rollback(sm, key)
+	}
+}
+
+// rollback sets key back to what it holds in the state. Called with n.mu
+// held.
+func (n *Node) rollback(sm *syncedMap, key []byte) {
+	value := n.raftMaps.lookup(sm.cfg.Name, key)
+	var err error
+	if value == nil {
+		err = sm.m.Delete(key)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			err = nil
+		}
+	} else {
+		err = sm.m.Update(key, value, ebpf.UpdateAny)
+	}
+	if err != nil {
+		applyLog.Error("Failed to roll back uncommitted change", "map", sm.cfg.Name, "key", sm.layout.formatKey(key), "error", err)
+		return
+	}
+	applyLog.Info("Rolled back uncommitted change", "map", sm.cfg.Name, "key", sm.layout.formatKey(key))
+}
+
+// Local changes wait this many election timeouts to be committed.
+const raftProposalTimeout = 5
+
+func (n *Node) Propose(ctx context.Context, in *ProposeRequest) (*ProposeResponse, error) {
+	if n.raft == nil {
+		return nil, status.Error(codes.Unimplemented, "raft is disabled")
+	}
+	for _, p := range in.GetProposals() {
+		switch MapUpdater(p.GetChange().GetType()) {
+		case MAP_UPDATE, MAP_DELETE:
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown update type %d", p.GetChange().GetType())
+		}
+		if p.GetChange().GetMap() == "" || p.GetChange().GetKeyData() == nil {
+			return nil, status.Error(codes.InvalidArgument, "proposals must name the map and set key_data")
+		}
+	}
+	conflicts, err := n.raft.propose(ctx, in.GetProposals(), false)
+	if err != nil {
+		return nil, err
+	}
+	return &ProposeResponse{Conflicts: conflicts}, nil
+}
+
+func (n *Node) RequestVote(ctx context.Context, in *VoteRequest) (*VoteResponse, error) {
+	if n.raft == nil {
+		return nil, status.Error(codes.Unimplemented, "raft is disabled")
+	}
+	return n.raft.vote(in), nil
+}
+
+func (n *Node) AppendEntries(ctx context.Context, in *AppendRequest) (*AppendResponse, error) {
+	if n.raft == nil {
+		return nil, status.Error(codes.Unimplemented, "raft is disabled")
+	}
+	return n.raft.append(in), nil
+}
+
+func (n *Node) InstallSnapshot(ctx context.Context, in *InstallSnapshotRequest) (*AppendResponse, error) {
+	if n.raft == nil {
+		return nil, status.Error(codes.Unimplemented, "raft is disabled")
+	}
+	return n.raft.installSnapshot(in), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// raftStorage keeps what a Raft member must not forget across restarts, in
+// dir: the term and vote in "state", the latest snapshot in "snapshot", and
+// the entries after it in "log". Entries are appended to the log as they
+// arrive, and the log is rewritten when it's truncated or compacted.
+type raftStorage struct {
+	dir string
+	log *os.File
+}
+
+type raftHardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// openRaftStorage returns the storage in dir along with its contents.
+func openRaftStorage(dir string) (*raftStorage, raftHardState, *RaftSnapshot, []*RaftEntry, error) {
+	var state raftHardState
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, state, nil, nil, err
+	}
+	s := &raftStorage{dir: dir}
+
+	data, err := os.ReadFile(s.path("state"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, state, nil, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, state, nil, nil, fmt.Errorf("%s: %w", s.path("state"), err)
+		}
+	}
+
+	snap := &RaftSnapshot{}
+	data, err = os.ReadFile(s.path("snapshot"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, state, nil, nil, err
+	}
+	if err := proto.Unmarshal(data, snap); err != nil {
+		return nil, state, nil, nil, fmt.Errorf("%s: %w", s.path("snapshot"), err)
+	}
+
+	s.log, err = os.OpenFile(s.path("log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, state, nil, nil, err
+	}
+	var entries []*RaftEntry
+	r := &countingReader{r: bufio.NewReader(s.log)}
+	next := snap.GetLastIndex() + 1
+	for {
+		e := &RaftEntry{}
+		good := r.n
+		err := protodelim.UnmarshalFrom(r, e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// A torn write at the tail: the entry was never acknowledged.
+			// Cut it off so new entries are appended after the last good one.
+			raftLog.Warn("Ignoring the unreadable end of the Raft log", "error", err)
+			if err := s.log.Truncate(good); err != nil {
+				s.log.Close()
+				return nil, state, nil, nil, err
+			}
+			break
+		}
+		// The log is rewritten after the snapshot is saved, a crash in
+		// between leaves entries the snapshot already covers.
+		if e.GetIndex() < next {
+			continue
+		}
+		if e.GetIndex() != next {
+			s.log.Close()
+			return nil, state, nil, nil, fmt.Errorf("%s: entry %d follows entry %d", s.path("log"), e.GetIndex(), next-1)
+		}
+		entries = append(entries, e)
+		next++
+	}
+	return s, state, snap, entries, nil
+}
+
+func (s *raftStorage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *raftStorage) saveState(state raftHardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path("state"), data)
+}
+
+// append adds entries at the end of the log.
+func (s *raftStorage) append(entries []*RaftEntry) error {
+	w := bufio.NewWriter(s.log)
+	for _, e := range entries {
+		if _, err := protodelim.MarshalTo(w, e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log with entries.
+func (s *raftStorage) rewrite(entries []*RaftEntry) error {
+	tmp := s.path("log.tmp")
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	old := s.log
+	s.log = f
+	if err := s.append(entries); err != nil {
+		s.log = old
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path("log")); err != nil {
+		s.log = old
+		f.Close()
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// saveSnapshot replaces the snapshot, and the log with the entries after it.
+func (s *raftStorage) saveSnapshot(snap *RaftSnapshot, entries []*RaftEntry) error {
+	data, err := proto.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(s.path("snapshot"), data); err != nil {
+		return err
+	}
+	return s.rewrite(entries)
+}
+
+func (s *raftStorage) Close() error {
+	return s.log.Close()
+}
+
+// writeFileSync replaces the file at path with data, so that a crash leaves
+// either the old or the new contents.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestRaft returns member a of a cluster with the given other members,
+// applying its log to a raftMaps.
+func newTestRaft(t *testing.T, others ...string) (*raft, *raftMaps) {
+	t.Helper()
+	cfg := RaftConfig{
+		Dir:               t.TempDir(),
+		Members:           []RaftMember{{Name: "a", Address: "127.0.0.1:1"}},
+		ElectionTimeout:   time.Second,
+		HeartbeatInterval: 100 * time.Millisecond,
+		SnapshotThreshold: 1000,
+	}
+	for _, name := range others {
+		cfg.Members = append(cfg.Members, RaftMember{Name: name, Address: "127.0.0.1:1"})
+	}
+	state := newRaftMaps()
+	r, err := newRaft("a", cfg, grpc.WithTransportCredentials(insecure.NewCredentials()), raftOptions{
+		apply:    state.apply,
+		snapshot: state.snapshot,
+		restore:  state.restore,
+	})
+	if err != nil {
+		t.Fatalf("creating raft: %v", err)
+	}
+	return r, state
+}
+
+func raftEntries(terms ...uint64) []*RaftEntry {
+	entries := make([]*RaftEntry, len(terms))
+	for i, term := range terms {
+		entries[i] = &RaftEntry{Index: uint64(i) + 1, Term: term}
+	}
+	return entries
+}
+
+func logTerms(r *raft) []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var terms []uint64
+	for _, e := range r.log {
+		terms = append(terms, e.GetTerm())
+	}
+	return terms
+}
+
+func TestRaftAppend(t *testing.T) {
+	tests := []struct {
+		name        string
+		log         []uint64 // Terms of the entries already in the log
+		req         *AppendRequest
+		wantSuccess bool
+		wantLast    uint64 // LastLogIndex of the response
+		want        []uint64
+		wantCommit  uint64
+	}{
+		{
+			name:        "empty log",
+			req:         &AppendRequest{Term: 1, Leader: "b", Entries: raftEntries(1, 1), LeaderCommit: 1},
+			wantSuccess: true, wantLast: 2, want: []uint64{1, 1}, wantCommit: 1,
+		},
+		{
+			name:     "stale leader",
+			log:      []uint64{2},
+			req:      &AppendRequest{Term: 1, Leader: "b", PrevLogIndex: 1, PrevLogTerm: 1},
+			wantLast: 1, want: []uint64{2},
+		},
+		{
+			name:     "gap",
+			log:      []uint64{1},
+			req:      &AppendRequest{Term: 1, Leader: "b", PrevLogIndex: 3, PrevLogTerm: 1, Entries: raftEntries(1, 1, 1, 1)[3:]},
+			wantLast: 1, want: []uint64{1},
+		},
+		{
+			name:     "previous entry differs",
+			log:      []uint64{1, 1},
+			req:      &AppendRequest{Term: 3, Leader: "b", PrevLogIndex: 2, PrevLogTerm: 2, Entries: raftEntries(1, 2, 3)[2:]},
+			wantLast: 1, want: []uint64{1, 1},
+		},
+		{
+			name:        "conflicting entries replaced",
+			log:         []uint64{1, 1, 1},
+			req:         &AppendRequest{Term: 2, Leader: "b", PrevLogIndex: 1, PrevLogTerm: 1, Entries: raftEntries(1, 2)[1:], LeaderCommit: 2},
+			wantSuccess: true, wantLast: 2, want: []uint64{1, 2}, wantCommit: 2,
+		},
+		{
+			name:        "entries already there",
+			log:         []uint64{1, 1, 1},
+			req:         &AppendRequest{Term: 1, Leader: "b", Entries: raftEntries(1, 1)},
+			wantSuccess: true, wantLast: 3, want: []uint64{1, 1, 1},
+		},
+		{
+			name:        "commit only up to what was sent",
+			log:         []uint64{1, 1, 1},
+			req:         &AppendRequest{Term: 1, Leader: "b", Entries: raftEntries(1), LeaderCommit: 3},
+			wantSuccess: true, wantLast: 3, want: []uint64{1, 1, 1}, wantCommit: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRaft(t, "b", "c")
+			if len(tt.log) > 0 {
+				last := tt.log[len(tt.log)-1]
+				if resp := r.append(&AppendRequest{Term: last, Leader: "b", Entries: raftEntries(tt.log...)}); !resp.GetSuccess() {
+					t.Fatalf("setting up the log: %v", resp)
+				}
+			}
+			resp := r.append(tt.req)
+			if resp.GetSuccess() != tt.wantSuccess || resp.GetLastLogIndex() != tt.wantLast {
+				t.Errorf("success %v with last index %d, want %v with %d", resp.GetSuccess(), resp.GetLastLogIndex(), tt.wantSuccess, tt.wantLast)
+			}
+			if got := logTerms(r); !equalTerms(got, tt.want) {
+				t.Errorf("log terms %v, want %v", got, tt.want)
+			}
+			if r.commit != tt.wantCommit {
+				t.Errorf("commit index %d, want %d", r.commit, tt.wantCommit)
+			}
+		})
+	}
+}
+
+func equalTerms(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRaftVote(t *testing.T) {
+	r, _ := newTestRaft(t, "b", "c")
+	r.append(&AppendRequest{Term: 2, Leader: "b", Entries: raftEntries(1, 2)})
+
+	tests := []struct {
+		name string
+		req  *VoteRequest
+		want bool
+	}{
+		{name: "stale term", req: &VoteRequest{Term: 1, Candidate: "c", LastLogIndex: 5, LastLogTerm: 2}},
+		{name: "older log", req: &VoteRequest{Term: 3, Candidate: "c", LastLogIndex: 5, LastLogTerm: 1}},
+		{name: "shorter log", req: &VoteRequest{Term: 3, Candidate: "c", LastLogIndex: 1, LastLogTerm: 2}},
+		{name: "granted", req: &VoteRequest{Term: 3, Candidate: "c", LastLogIndex: 2, LastLogTerm: 2}, want: true},
+		{name: "again", req: &VoteRequest{Term: 3, Candidate: "c", LastLogIndex: 2, LastLogTerm: 2}, want: true},
+		{name: "already voted", req: &VoteRequest{Term: 3, Candidate: "b", LastLogIndex: 2, LastLogTerm: 2}},
+	}
+	for _, tt := range tests {
+		if resp := r.vote(tt.req); resp.GetGranted() != tt.want {
+			t.Errorf("%s: granted %v, want %v", tt.name, resp.GetGranted(), tt.want)
+		}
+	}
+}
+
+func TestRaftForgetsDeposedLeader(t *testing.T) {
+	r, _ := newTestRaft(t, "b", "c")
+	r.append(&AppendRequest{Term: 2, Leader: "b"})
+	r.vote(&VoteRequest{Term: 3, Candidate: "c"})
+
+	// Proposals must not be forwarded to b, which no longer leads.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leader != "" {
+		t.Errorf("leader of term 3 is %q before hearing from it", r.leader)
+	}
+}
+
+func TestRaftProposeCommits(t *testing.T) {
+	r, state := newTestRaft(t)
+	go r.applyCommitted()
+	r.campaign()
+
+	change := func(value string) *ValueRequest {
+		return &ValueRequest{Map: "m", KeyData: []byte("k"), ValueData: []byte(value), Type: int32(MAP_UPDATE)}
+	}
+	proposals := []*Proposal{
+		{Change: change("1"), Conditional: true},
+		{Change: change("2"), Conditional: true, Expected: []byte("1")},
+		{Change: change("3"), Conditional: true, Expected: []byte("1")},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conflicts, err := r.propose(ctx, proposals, false)
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if want := []bool{false, false, true}; len(conflicts) != 3 || conflicts[0] != want[0] || conflicts[1] != want[1] || conflicts[2] != want[2] {
+		t.Errorf("conflicts %v, want %v", conflicts, want)
+	}
+	if got := state.lookup("m", []byte("k")); string(got) != "2" {
+		t.Errorf("state holds %q, want 2", got)
+	}
+}
+
+func TestRaftInstallSnapshotFailsWaiters(t *testing.T) {
+	r, state := newTestRaft(t, "b", "c")
+	r.mu.Lock()
+	r.term = 1
+	r.lead()
+	r.mu.Unlock()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.propose(context.Background(), []*Proposal{{Change: &ValueRequest{Map: "m", KeyData: []byte("k"), ValueData: []byte("1")}}}, false)
+		errs <- err
+	}()
+	for {
+		r.mu.Lock()
+		n := len(r.waiting)
+		r.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	snap := &Snapshot{Maps: []*MapSnapshot{{Name: "m", Entries: []*Entry{{Key: []byte("k"), Value: []byte("2")}}}}}
+	r.installSnapshot(&InstallSnapshotRequest{Term: 2, Leader: "b", Snapshot: &RaftSnapshot{LastIndex: 5, LastTerm: 2, State: snap}})
+	select {
+	case err := <-errs:
+		if status.Code(err) != codes.Aborted {
+			t.Errorf("proposal covered by a snapshot failed with %v, want Aborted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proposal covered by a snapshot still waiting")
+	}
+	if got := state.lookup("m", []byte("k")); string(got) != "2" {
+		t.Errorf("state holds %q after the snapshot, want 2", got)
+	}
+}
+
+func TestRaftMapsApply(t *testing.T) {
+	update := func(value string) *ValueRequest {
+		return &ValueRequest{Map: "m", KeyData: []byte("k"), ValueData: []byte(value), Type: int32(MAP_UPDATE)}
+	}
+	del := &ValueRequest{Map: "m", KeyData: []byte("k"), Type: int32(MAP_DELETE)}
+	tests := []struct {
+		name         string
+		proposals    []*Proposal
+		wantConflict []bool
+		want         []byte
+	}{
+		{name: "unconditional", proposals: []*Proposal{{Change: update("1")}, {Change: update("2")}}, wantConflict: []bool{false, false}, want: []byte("2")},
+		{name: "expected missing", proposals: []*Proposal{{Change: update("1"), Conditional: true}}, wantConflict: []bool{false}, want: []byte("1")},
+		{name: "expected value", proposals: []*Proposal{{Change: update("1")}, {Change: update("2"), Conditional: true, Expected: []byte("1")}}, wantConflict: []bool{false, false}, want: []byte("2")},
+		{name: "conflict", proposals: []*Proposal{{Change: update("1")}, {Change: update("2"), Conditional: true, Expected: []byte("0")}}, wantConflict: []bool{false, true}, want: []byte("1")},
+		{name: "delete", proposals: []*Proposal{{Change: update("1")}, {Change: del, Conditional: true, Expected: []byte("1")}}, wantConflict: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRaftMaps()
+			for i, p := range tt.proposals {
+				if got := s.apply(p); got != tt.wantConflict[i] {
+					t.Errorf("proposal %d conflicted %v, want %v", i, got, tt.wantConflict[i])
+				}
+			}
+			if got := s.lookup("m", []byte("k")); string(got) != string(tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("state holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaftMapsPendingChanges(t *testing.T) {
+	s := newRaftMaps()
+	s.apply(&Proposal{Change: &ValueRequest{Map: "m", KeyData: []byte("k"), ValueData: []byte("0")}})
+
+	first := &ValueRequest{Map: "m", KeyData: []byte("k"), ValueData: []byte("1"), Type: int32(MAP_UPDATE)}
+	second := &ValueRequest{Map: "m", KeyData: []byte("k"), ValueData: []byte("2"), Type: int32(MAP_UPDATE)}
+	if p := s.propose(first); string(p.GetExpected()) != "0" {
+		t.Errorf("first change expects %q, want the committed 0", p.GetExpected())
+	}
+	if p := s.propose(second); string(p.GetExpected()) != "1" {
+		t.Errorf("second change expects %q, want 1 set by the first", p.GetExpected())
+	}
+	if s.done(first) {
+		t.Error("first change reported as the last pending")
+	}
+	if !s.isPending("m", []byte("k")) {
+		t.Error("key no longer pending with a change left")
+	}
+	if !s.done(second) {
+		t.Error("second change not reported as the last pending")
+	}
+	if s.isPending("m", []byte("k")) {
+		t.Error("key still pending")
+	}
+}
+
+func TestRaftStorageCutsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _, _, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append(raftEntries(1)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Half of a second entry made it to disk before a crash.
+	f, err := os.OpenFile(filepath.Join(dir, "log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x20, 0x08})
+	f.Close()
+
+	s, _, _, entries, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("read %d entries from a log with a torn tail, want 1", len(entries))
+	}
+	if err := s.append(raftEntries(1, 1)[1:]); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, _, _, entries, err = openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(entries) != 2 {
+		t.Errorf("read %d entries after appending to a log with a torn tail, want 2", len(entries))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mapRegistry hands out the IDs peers use to refer to our maps instead of
+// their names. Map names are the same across the cluster, IDs are ours only
+// and are exchanged in the handshake. They are never reused while the process
+// runs, and the epoch, random for every run, tells those of a previous run
+// apart, so a peer holding a stale ID gets an error rather than writing to
+// another map.
+type mapRegistry struct {
+	ids   map[string]uint32
+	last  uint32
+	epoch uint64
+}
+
+// ref returns the ID of the named map, assigning one if needed.
+func (r *mapRegistry) ref(name string) uint32 {
+	if r.ids == nil {
+		r.ids = make(map[string]uint32)
+	}
+	id, ok := r.ids[name]
+	if !ok {
+		r.last++
+		id = r.last
+		r.ids[name] = id
+	}
+	return id
+}
+
+// hello describes this node and its maps.
+func (n *Node) hello() *Hello {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	h := &Hello{Node: n.name, ProtocolVersion: protocolVersion, Capabilities: capabilities, Epoch: n.refs.epoch}
+	for name, sm := range n.maps {
+		h.Maps = append(h.Maps, &MapRef{
+			Name:       name,
+			Id:         sm.ref,
+			Type:       sm.m.Type().String(),
+			KeySize:    sm.m.KeySize(),
+			ValueSize:  sm.m.ValueSize(),
+			MaxEntries: sm.m.MaxEntries(),
+			BtfHash:    sm.layout.hash(),
+			Accepts:    sm.cfg.receives(),
+		})
+	}
+	return h
+}
+
+func (n *Node) Handshake(ctx context.Context, in *Hello) (*Hello, error) {
+	if err := checkProtocolVersion(in.GetProtocolVersion()); err != nil {
+		replicationLog.Error("Refusing peer", "peer", in.GetNode(), "error", err)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	h := n.hello()
+	// The sender decides what to send, this is only so both sides log it.
+	local := make(map[string]*MapRef, len(h.GetMaps()))
+	for _, m := range h.GetMaps() {
+		local[m.GetName()] = m
+	}
+	for _, remote := range in.GetMaps() {
+		if m, ok := local[remote.GetName()]; ok && m.GetAccepts() {
+			logSchemaMismatch(in.GetNode(), m, remote)
+		}
+	}
+	replicationLog.Debug("Handshake", "peer", in.GetNode(), "maps", len(in.GetMaps()))
+	return h, nil
+}
+
+// targetMap returns the map a change from a peer is for.
+func (n *Node) targetMap(in *ValueRequest) (*syncedMap, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var sm *syncedMap
+	var ok bool
+	switch {
+	case in.GetMapRef() != 0:
+		// Either error makes the sender handshake again.
+		if in.GetEpoch() != n.refs.epoch {
+			return nil, status.Errorf(codes.FailedPrecondition, "map ID %d is from before this node restarted", in.GetMapRef())
+		}
+		if sm, ok = n.byRef[in.GetMapRef()]; !ok {
+			// Most likely the map was removed since the handshake.
+			return nil, status.Errorf(codes.FailedPrecondition, "unknown map ID %d", in.GetMapRef())
+		}
+	case in.GetMap() != "":
+		sm, ok = n.maps[in.GetMap()]
+	default:
+		// Senders from before the handshake only replicate hash_map.
+		sm, ok = n.maps[ownMapName]
+	}
+	if !ok || !sm.cfg.receives() {
+		name := in.GetMap()
+		if name == "" {
+			name = ownMapName
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "map %s does not accept changes from peers", name)
+	}
+	return sm, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// readConfig reads the config the same way it was read at startup, so flags
+// keep overriding the file.
+func (n *Node) readConfig() (Config, error) {
+	cfg := defaultConfig()
+	if n.configPath != "" {
+		var err error
+		cfg, err = loadConfig(n.configPath)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, n.applyFlags(&cfg)
+}
+
+// restartOnly returns the settings that can't be changed by a reload.
+func restartOnly(c Config) Config {
+	return Config{Node: c.Node, Listen: c.Listen, Metrics: c.Metrics, Attach: c.Attach, Pins: c.Pins, TLS: c.TLS, Gossip: c.Gossip, Raft: c.Raft, Discovery: c.Discovery, Logging: c.Logging, Queue: c.Queue, Batch: c.Batch, ChangeLog: c.ChangeLog}
+}
+
+// applyConfig brings the maps and peers of the node in line with cfg and
+// returns what changed. The rest of the settings only take effect on restart.
+func (n *Node) applyConfig(cfg Config) ([]string, error) {
+	maps, err := resolveMaps(&cfg, &n.syncObjs)
+	if err != nil {
+		return nil, err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			closeMaps(maps)
+		}
+	}()
+
+	// Stopping a peer waits for its pending resync, which needs the lock.
+	var stopped []*Peer
+	var released map[string]*syncedMap
+	defer func() {
+		for _, p := range stopped {
+			p.Stop()
+		}
+		closeMaps(released)
+	}()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.maps != nil {
+		if !reflect.DeepEqual(restartOnly(n.cfg), restartOnly(cfg)) {
+			slog.Warn("Changes to the node, listen, metrics, attach, pins, tls, gossip, raft, discovery, logging, queue, batch and changelog settings only take effect on restart")
+		}
+		next := n.cfg
+		next.Peers, next.Maps = cfg.Peers, cfg.Maps
+		cfg = next
+	}
+
+	// The Raft log only holds the changes made while a map was replicated
+	// through it.
+	for name, sm := range n.maps {
+		if next, ok := maps[name]; ok && next.cfg.raft() != sm.cfg.raft() {
+			return nil, fmt.Errorf("map %s: replicating through raft or not only changes on restart", name)
+		}
+	}
+
+	var changes []string
+	// Maps: the allowlist is updated in place, the programs stay attached.
+	// Maps no longer sent are only taken off it once the rest succeeded.
+	var disallowed []*syncedMap
+	for name, sm := range n.maps {
+		next, ok := maps[name]
+		if ok && next.id == sm.id && reflect.DeepEqual(next.cfg, sm.cfg) {
+			continue
+		}
+		if sm.cfg.sends() && (!ok || next.id != sm.id || !next.cfg.sends()) {
+			disallowed = append(disallowed, sm)
+		}
+		if ok {
+			changes = append(changes, fmt.Sprintf("map %s: updated", name))
+		} else {
+			changes = append(changes, fmt.Sprintf("map %s: removed", name))
+		}
+	}
+	for name := range maps {
+		if _, ok := n.maps[name]; !ok {
+			changes = append(changes, fmt.Sprintf("map %s: added", name))
+		}
+	}
+	// Filters first, so no change the kernel should skip is let through.
+	err = setKernelFilters(n.syncObjs.MapFilters, n.maps, maps)
+	if err == nil {
+		err = allowMaps(n.syncObjs.MapAllowlist, maps)
+	}
+	if err != nil {
+		n.restoreKernelMaps(maps)
+		return changes, err
+	}
+	for _, sm := range disallowed {
+		id := uint32(sm.id)
+		if err := n.syncObjs.MapAllowlist.Delete(&id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			// Harmless: changes of maps the node no longer knows are ignored.
+			slog.Warn("Failed to remove map from the allowlist", "map", sm.cfg.Name, "error", err)
+		}
+	}
+	// Pinned maps that are still the same map keep their handle, requests in
+	// flight may be using it. The others are closed once the lock is released.
+	released = make(map[string]*syncedMap)
+	for name, sm := range n.maps {
+		if !sm.pinned {
+			continue
+		}
+		if next, ok := maps[name]; ok && next.pinned && next.id == sm.id {
+			next.m.Close()
+			next.m = sm.m
+		} else {
+			released[name] = sm
+		}
+	}
+	previous := n.maps
+	n.maps, swapped = maps, true
+	n.byID = make(map[uint32]*syncedMap, len(maps))
+	n.byRef = make(map[uint32]*syncedMap, len(maps))
+	for _, mc := range cfg.Maps {
+		sm := maps[mc.Name]
+		sm.ref = n.refs.ref(mc.Name)
+		n.byID[uint32(sm.id)] = sm
+		n.byRef[sm.ref] = sm
+	}
+	// New raft maps, or pinned ones recreated by their loader, start out
+	// with the committed state.
+	for name, sm := range maps {
+		if old, ok := previous[name]; sm.cfg.raft() && n.raft != nil && (!ok || old.id != sm.id) {
+			n.syncRaftMap(sm)
+		}
+	}
+
+	// The maps are in place whatever happens to the peers, which are
+	// retried on the next reload or membership change.
+	n.cfg = cfg
+	peerChanges, stoppedPeers, err := n.updatePeers(cfg)
+	changes, stopped = append(changes, peerChanges...), stoppedPeers
+	return changes, err
+}
+
+// restoreKernelMaps undoes what a failed reload to maps did to the filters
+// and allowlist of the kernel, which must again match n.maps. Called with
+// n.mu held.
+func (n *Node) restoreKernelMaps(maps map[string]*syncedMap) {
+	if err := setKernelFilters(n.syncObjs.MapFilters, maps, n.maps); err != nil {
+		slog.Error("Failed to restore kernel filters after a failed reload", "error", err)
+	}
+	sent := make(map[ebpf.MapID]bool)
+	for _, sm := range n.maps {
+		if sm.cfg.sends() {
+			sent[sm.id] = true
+		}
+	}
+	for _, sm := range maps {
+		id := uint32(sm.id)
+		if sm.cfg.sends() && !sent[sm.id] {
+			if err := n.syncObjs.MapAllowlist.Delete(&id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				slog.Error("Failed to restore the allowlist after a failed reload", "map", sm.cfg.Name, "error", err)
+			}
+		}
+	}
+}
+
+// updatePeers brings the peers in line with the configured ones, the
+// discovered ones and the members of the cluster, and returns what changed along with the peers to
+// stop once n.mu is released. Called with n.mu held.
+func (n *Node) updatePeers(cfg Config) (changes []string, stopped []*Peer, err error) {
+	creds, err := clientCredentials(cfg.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Removed peers are stopped, dropping whatever they still had queued.
+	wanted := make(map[string]PeerConfig, len(cfg.Peers))
+	var order []PeerConfig
+	for _, pc := range cfg.Peers {
+		wanted[pc.Address] = pc
+		order = append(order, pc)
+	}
+	for _, peers := range n.discovered {
+		for _, addr := range peers {
+			if _, ok := wanted[addr]; !ok {
+				wanted[addr] = PeerConfig{Address: addr}
+				order = append(order, wanted[addr])
+			}
+		}
+	}
+	if n.gossip != nil {
+		for _, pc := range n.gossip.peers() {
+			if _, ok := wanted[pc.Address]; !ok {
+				wanted[pc.Address] = pc
+				order = append(order, pc)
+			}
+		}
+	}
+	for addr, p := range n.peers {
+		if pc, ok := wanted[addr]; ok {
+			if p.setConfig(pc) {
+				membershipLog.Info("Peer updated", "peer", addr, "compression", pc.Compression)
+				changes = append(changes, fmt.Sprintf("peer %s: updated", addr))
+			}
+			continue
+		}
+		stopped = append(stopped, p)
+		delete(n.peers, addr)
+		membershipLog.Info("Peer removed", "peer", addr)
+		changes = append(changes, fmt.Sprintf("peer %s: removed", addr))
+	}
+	for _, pc := range order {
+		if _, ok := n.peers[pc.Address]; ok {
+			continue
+		}
+		p, err := newPeer(pc, peerOptions{
+			creds:      creds,
+			queueSize:  cfg.Queue.Size,
+			queueDir:   cfg.Queue.Dir,
+			batchSize:  cfg.Batch.MaxSize,
+			snapshot:   n.resyncRequests,
+			hello:      n.hello,
+			movedOwner: n.movedOwner,
+		})
+		if err != nil {
+			return changes, stopped, fmt.Errorf("peer %s: %w", pc.Address, err)
+		}
+		p.Start()
+		n.peers[pc.Address] = p
+		membershipLog.Info("Peer added", "peer", pc.Address)
+		changes = append(changes, fmt.Sprintf("peer %s: added", pc.Address))
+	}
+	return changes, stopped, nil
+}
+
+// refreshPeers updates the peers after discovery or gossip found others.
+func (n *Node) refreshPeers() {
+	n.reloadMu.Lock()
+	n.mu.Lock()
+	changes, stopped, err := n.updatePeers(n.cfg)
+	n.mu.Unlock()
+	n.reloadMu.Unlock()
+
+	// Stopping a peer waits for its pending resync, which needs the lock.
+	for _, p := range stopped {
+		p.Stop()
+	}
+	for _, c := range changes {
+		membershipLog.Info("Peers changed", "change", c)
+	}
+	if err != nil {
+		membershipLog.Error("Failed to update peers", "error", err)
+	}
+}
+
+// resyncRequests returns the full state of the maps whose changes are sent to peers.
+func (n *Node) resyncRequests() ([]*ValueRequest, error) {
+	n.mu.RLock()
+	maps, origin := n.maps, n.name
+	n.mu.RUnlock()
+	reqs, err := resyncRequests(maps, origin)
+	if err != nil {
+		return nil, err
+	}
+	// Keys of maps with ownership are only sent by their owner.
+	return n.ownedOnly(reqs), nil
+}
+
+func (n *Node) reload() ([]string, error) {
+	n.reloadMu.Lock()
+	defer n.reloadMu.Unlock()
+	cfg, err := n.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := n.applyConfig(cfg)
+	for _, c := range changes {
+		slog.Info("Reloaded", "change", c)
+	}
+	return changes, err
+}
+
+func (n *Node) Reload(ctx context.Context, in *Empty) (*ReloadResponse, error) {
+	changes, err := n.reload()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "reload failed: %v", err)
+	}
+	return &ReloadResponse{Changes: changes}, nil
+}
+
+// followPins reopens pinned maps whenever their loader recreated them, so the
+// new map is synchronized in place of the old one.
+func (n *Node) followPins(interval time.Duration) {
+	for range time.Tick(interval) {
+		n.mu.RLock()
+		var moved []string
+		for name, sm := range n.maps {
+			if !sm.pinned {
+				continue
+			}
+			id, err := pinnedMapID(sm.cfg.Pin)
+			if err != nil {
+				// The loader may be in the middle of replacing it.
+				slog.Debug("Pinned map is unavailable", "map", name, "pin", sm.cfg.Pin, "error", err)
+				continue
+			}
+			if id != sm.id {
+				moved = append(moved, name)
+			}
+		}
+		n.mu.RUnlock()
+		if len(moved) == 0 {
+			continue
+		}
+
+		slog.Info("Pinned maps were recreated, reopening them", "maps", moved)
+		n.reloadMu.Lock()
+		n.mu.RLock()
+		cfg := n.cfg
+		n.mu.RUnlock()
+		if _, err := n.applyConfig(cfg); err != nil {
+			slog.Error("Failed to reopen pinned maps", "error", err)
+		}
+		n.reloadMu.Unlock()
+	}
+}
+
+// reloadOnSIGHUP reloads the config every time the process gets a SIGHUP.
+func (n *Node) reloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		slog.Info("Got SIGHUP, reloading config")
+		if _, err := n.reload(); err != nil {
+			slog.Error("Reload failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// reloadCommand implements `map-sync reload`, the same as sending SIGHUP to the daemon.
+func reloadCommand(args []string) {
+	fs := flag.NewFlagSet("reload", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:50051", "Address of the daemon to reload")
+	tlsConfig := tlsFlags(fs)
+	fs.Parse(args)
+
+	client, conn := dialDaemon(*addr, tlsConfig)
+	defer conn.Close()
+	resp, err := client.Reload(context.Background(), &Empty{})
+	if err != nil {
+		log.Fatalf("Failed to reload: %v", err)
+	}
+	if len(resp.GetChanges()) == 0 {
+		fmt.Println("No changes")
+	}
+	for _, c := range resp.GetChanges() {
+		fmt.Println(c)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// compareSchema checks whether changes of local can be applied to remote. A
+// non-nil error means they can't, warnings mean they can but the maps may
+// still end up different.
+func compareSchema(local, remote *MapRef) (warnings []string, err error) {
+	var problems []string
+	if local.GetType() != remote.GetType() {
+		problems = append(problems, fmt.Sprintf("type is %s here and %s on the peer", local.GetType(), remote.GetType()))
+	}
+	if local.GetKeySize() != remote.GetKeySize() {
+		problems = append(problems, fmt.Sprintf("key size is %d here and %d on the peer", local.GetKeySize(), remote.GetKeySize()))
+	}
+	if local.GetValueSize() != remote.GetValueSize() {
+		problems = append(problems, fmt.Sprintf("value size is %d here and %d on the peer", local.GetValueSize(), remote.GetValueSize()))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("map %s: %s", local.GetName(), strings.Join(problems, ", "))
+	}
+
+	if local.GetMaxEntries() > remote.GetMaxEntries() {
+		warnings = append(warnings, fmt.Sprintf("map %s holds %d entries here but only %d on the peer", local.GetName(), local.GetMaxEntries(), remote.GetMaxEntries()))
+	}
+	if local.GetBtfHash() != "" && remote.GetBtfHash() != "" && local.GetBtfHash() != remote.GetBtfHash() {
+		warnings = append(warnings, fmt.Sprintf("map %s has the same sizes but different key or value types here and on the peer", local.GetName()))
+	}
+	return warnings, nil
+}
+
+// logSchemaMismatch logs what's wrong with replicating local to remote, and
+// reports whether it's refused.
+func logSchemaMismatch(peer string, local, remote *MapRef) bool {
+	warnings, err := compareSchema(local, remote)
+	for _, w := range warnings {
+		replicationLog.Warn("Map schemas differ", "peer", peer, "map", local.GetName(), "problem", w)
+	}
+	if err != nil {
+		schemaMismatches.Add(local.GetName(), 1)
+		replicationLog.Error("Map schemas are incompatible, not replicating the map with this peer", "peer", peer, "map", local.GetName(), "error", err)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Bump whenever snapshotFile changes in a way older versions can't read.
+const snapshotVersion = 1
+
+// snapshotFile is the on-disk format of `map-sync snapshot export`.
+type snapshotFile struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Node    string        `json:"node,omitempty"`
+	Maps    []snapshotMap `json:"maps"`
+}
+
+type snapshotMap struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	KeySize    uint32          `json:"key_size"`
+	ValueSize  uint32          `json:"value_size"`
+	MaxEntries uint32          `json:"max_entries"`
+	Entries    []snapshotEntry `json:"entries"`
+	// BTF of the key and value types, if the map has any.
+	BTF            []byte `json:"btf,omitempty"`
+	BTFKeyTypeID   uint32 `json:"btf_key_type_id,omitempty"`
+	BTFValueTypeID uint32 `json:"btf_value_type_id,omitempty"`
+}
+
+// Keys and values are hex encoded in the map's native byte layout. The
+// decoded text is only there for people reading the file, import ignores it.
+type snapshotEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	KeyText   string `json:"key_text,omitempty"`
+	ValueText string `json:"value_text,omitempty"`
+}
+
+func writeSnapshotFile(w io.Writer, node string, snap *Snapshot) error {
+	f := snapshotFile{Version: snapshotVersion, Created: time.Now().UTC(), Node: node}
+	for _, m := range snap.GetMaps() {
+		sm := snapshotMap{
+			Name:           m.GetName(),
+			Type:           m.GetType(),
+			KeySize:        m.GetKeySize(),
+			ValueSize:      m.GetValueSize(),
+			MaxEntries:     m.GetMaxEntries(),
+			BTF:            m.GetBtf(),
+			BTFKeyTypeID:   m.GetBtfKeyTypeId(),
+			BTFValueTypeID: m.GetBtfValueTypeId(),
+			Entries:        make([]snapshotEntry, 0, len(m.GetEntries())),
+		}
+		layout, err := unmarshalMapLayout(m.GetBtf(), m.GetBtfKeyTypeId(), m.GetBtfValueTypeId())
+		if err != nil {
+			return fmt.Errorf("map %s: reading BTF: %w", m.GetName(), err)
+		}
+		for _, e := range m.GetEntries() {
+			se := snapshotEntry{Key: hex.EncodeToString(e.GetKey()), Value: hex.EncodeToString(e.GetValue())}
+			if layout != nil {
+				se.KeyText, se.ValueText = layout.formatKey(e.GetKey()), layout.formatValue(e.GetValue())
+			}
+			sm.Entries = append(sm.Entries, se)
+		}
+		f.Maps = append(f.Maps, sm)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&f)
+}
+
+func readSnapshotFile(r io.Reader) (*Snapshot, error) {
+	var f snapshotFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected %d", f.Version, snapshotVersion)
+	}
+
+	snap := &Snapshot{}
+	for _, sm := range f.Maps {
+		m := &MapSnapshot{
+			Name:           sm.Name,
+			Type:           sm.Type,
+			KeySize:        sm.KeySize,
+			ValueSize:      sm.ValueSize,
+			MaxEntries:     sm.MaxEntries,
+			Btf:            sm.BTF,
+			BtfKeyTypeId:   sm.BTFKeyTypeID,
+			BtfValueTypeId: sm.BTFValueTypeID,
+		}
+		for i, e := range sm.Entries {
+			key, err := hex.DecodeString(e.Key)
+			if err != nil {
+				return nil, fmt.Errorf("map %s entry %d: key: %w", sm.Name, i, err)
+			}
+			value, err := hex.DecodeString(e.Value)
+			if err != nil {
+				return nil, fmt.Errorf("map %s entry %d: value: %w", sm.Name, i, err)
+			}
+			if uint32(len(key)) != sm.KeySize || uint32(len(value)) != sm.ValueSize {
+				return nil, fmt.Errorf("map %s entry %d: size doesn't match the map's key/value size", sm.Name, i)
+			}
+			m.Entries = append(m.Entries, &Entry{Key: key, Value: value})
+		}
+		snap.Maps = append(snap.Maps, m)
+	}
+	return snap, nil
+}
+
+// snapshotOf reads the metadata and every entry of m.
+func snapshotOf(name string, m *ebpf.Map) (*MapSnapshot, error) {
+	ms := &MapSnapshot{
+		Name:       name,
+		Type:       m.Type().String(),
+		KeySize:    m.KeySize(),
+		ValueSize:  m.ValueSize(),
+		MaxEntries: m.MaxEntries(),
+	}
+	var key, value []byte
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		ms.Entries = append(ms.Entries, &Entry{Key: append([]byte(nil), key...), Value: append([]byte(nil), value...)})
+	}
+	return ms, iter.Err()
+}
+
+func (n *Node) Dump(ctx context.Context, in *Empty) (*Snapshot, error) {
+	n.mu.RLock()
+	maps := n.maps
+	n.mu.RUnlock()
+
+	snap := &Snapshot{}
+	for name, sm := range maps {
+		ms, err := snapshotOf(name, sm.m)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "dumping %s: %v", name, err)
+		}
+		if ms.Btf, ms.BtfKeyTypeId, ms.BtfValueTypeId, err = sm.layout.marshal(); err != nil {
+			slog.Warn("Can't encode the BTF of a map, dumping it without", "map", name, "error", err)
+			ms.Btf, ms.BtfKeyTypeId, ms.BtfValueTypeId = nil, 0, 0
+		}
+		snap.Maps = append(snap.Maps, ms)
+	}
+	return snap, nil
+}
+
+func (n *Node) Restore(ctx context.Context, in *RestoreRequest) (*Empty, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	// Check everything up front so a bad snapshot doesn't leave maps half restored.
+	for _, ms := range in.GetSnapshot().GetMaps() {
+		sm, ok := n.maps[ms.GetName()]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "map %s is not synchronized by this node", ms.GetName())
+		}
+		if sm.cfg.raft() {
+			return nil, status.Errorf(codes.FailedPrecondition, "map %s is replicated through raft, its contents are those of the Raft log", ms.GetName())
+		}
+		m := sm.m
+		if ms.GetType() != m.Type().String() || ms.GetKeySize() != m.KeySize() || ms.GetValueSize() != m.ValueSize() {
+			return nil, status.Errorf(codes.FailedPrecondition, "map %s: snapshot is a %s with %d byte keys and %d byte values, local map is a %s with %d byte keys and %d byte values",
+				ms.GetName(), ms.GetType(), ms.GetKeySize(), ms.GetValueSize(), m.Type(), m.KeySize(), m.ValueSize())
+		}
+	}
+
+	for _, ms := range in.GetSnapshot().GetMaps() {
+		sm := n.maps[ms.GetName()]
+		m := sm.m
+		if in.GetReplace() {
+			current, err := snapshotOf(ms.GetName(), m)
+			if err != nil {
+				return nil, applyStatus(err)
+			}
+			keep := make(map[string]bool, len(ms.GetEntries()))
+			for _, e := range ms.GetEntries() {
+				keep[string(e.GetKey())] = true
+			}
+			for _, e := range current.GetEntries() {
+				if keep[string(e.GetKey())] {
+					continue
+				}
+				if err := m.Delete(e.GetKey()); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+					return nil, applyStatus(err)
+				}
+				n.restored(sm, MAP_DELETE, e, in.GetPush())
+			}
+		}
+		for _, e := range ms.GetEntries() {
+			if err := m.Update(e.GetKey(), e.GetValue(), ebpf.UpdateAny); err != nil {
+				return nil, applyStatus(err)
+			}
+			n.restored(sm, MAP_UPDATE, e, in.GetPush())
+		}
+		slog.Info("Restored map", "map", ms.GetName(), "entries", len(ms.GetEntries()))
+	}
+	return &Empty{}, nil
+}
+
+// restored logs a change made by Restore and, if push is set, sends it to
+// peers like a local change of the map. It's called with n.mu held.
+func (n *Node) restored(sm *syncedMap, op MapUpdater, e *Entry, push bool) {
+	var value []byte
+	if op == MAP_UPDATE {
+		value = e.GetValue()
+	}
+	if push && sm.cfg.sends() {
+		n.replicate(sm, op, e.GetKey(), value)
+		return
+	}
+	if sm.cfg.tracksOrigins() {
+		n.origins.forget(sm.cfg.Name, e.GetKey())
+	}
+	n.mutated(n.name, sm, op, e.GetKey(), value)
+}
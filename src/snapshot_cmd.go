@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// snapshotCommand implements `map-sync snapshot <export|import>`.
+func snapshotCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: map-sync snapshot <export|import> [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "export":
+		snapshotExport(args[1:])
+	case "import":
+		snapshotImport(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown snapshot command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// tlsFlags registers the flags of the TLS settings used to connect to a daemon.
+func tlsFlags(fs *flag.FlagSet) *TLSConfig {
+	c := &TLSConfig{}
+	fs.StringVar(&c.Cert, "tls-cert", "", "TLS client certificate")
+	fs.StringVar(&c.Key, "tls-key", "", "TLS client key")
+	fs.StringVar(&c.CA, "tls-ca", "", "CA that signs the daemon's certificate")
+	fs.StringVar(&c.ServerName, "tls-server-name", "", "Name to verify the daemon's certificate against, instead of the address")
+	return c
+}
+
+func dialDaemon(addr string, tlsConfig *TLSConfig) (SyncServiceClient, *grpc.ClientConn) {
+	creds, err := clientCredentials(*tlsConfig)
+	if err != nil {
+		log.Fatalf("Failed to load TLS credentials: %v", err)
+	}
+	conn, err := grpc.NewClient(addr, creds,
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMessageSize), grpc.MaxCallSendMsgSize(maxMessageSize)))
+	if err != nil {
+		log.Fatalf("Failed to connect to %s: %v", addr, err)
+	}
+	return NewSyncServiceClient(conn), conn
+}
+
+func snapshotExport(args []string) {
+	fs := flag.NewFlagSet("snapshot export", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:50051", "Address of the daemon to export from")
+	out := fs.String("o", "", "File to write the snapshot to, stdout if empty")
+	compression := fs.String("compression", "", "Compress the snapshot in transit with this compressor ("+strings.Join(compressors, ", ")+")")
+	tlsConfig := tlsFlags(fs)
+	fs.Parse(args)
+
+	client, conn := dialDaemon(*addr, tlsConfig)
+	defer conn.Close()
+	// The daemon answers with the compressor of the request.
+	snap, err := client.Dump(context.Background(), &Empty{}, compressorOption(*compression)...)
+	if err != nil {
+		log.Fatalf("Failed to dump maps: %v", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	if err := writeSnapshotFile(w, *addr, snap); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func snapshotImport(args []string) {
+	fs := flag.NewFlagSet("snapshot import", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:50051", "Address of the daemon to import into")
+	in := fs.String("i", "", "File to read the snapshot from, stdin if empty")
+	replace := fs.Bool("replace", false, "Delete entries missing from the snapshot")
+	push := fs.Bool("push", false, "Also send the imported entries to the daemon's peers")
+	compression := fs.String("compression", "", "Compress the snapshot in transit with this compressor ("+strings.Join(compressors, ", ")+")")
+	tlsConfig := tlsFlags(fs)
+	fs.Parse(args)
+
+	r := os.Stdin
+	if *in != "" {
+		var err error
+		r, err = os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer r.Close()
+	}
+	snap, err := readSnapshotFile(r)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	client, conn := dialDaemon(*addr, tlsConfig)
+	defer conn.Close()
+	_, err = client.Restore(context.Background(), &RestoreRequest{Snapshot: snap, Replace: *replace, Push: *push}, compressorOption(*compression)...)
+	if err != nil {
+		log.Fatalf("Failed to restore maps: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// applyStatus maps an error returned by a BPF map operation to a gRPC status
+// that tells the sender what went wrong on our side.
+func applyStatus(err error) error {
+	var errno unix.Errno
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ebpf.ErrKeyNotExist):
+		code = codes.NotFound
+	case errors.Is(err, ebpf.ErrKeyExist):
+		code = codes.AlreadyExists
+	case errors.Is(err, ebpf.ErrNotSupported):
+		code = codes.Unimplemented
+	case errors.Is(err, unix.E2BIG), errors.Is(err, unix.ENOSPC), errors.Is(err, unix.ENOMEM):
+		// htab returns E2BIG once max_entries is reached.
+		code = codes.ResourceExhausted
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		code = codes.PermissionDenied
+	case errors.Is(err, unix.EINVAL):
+		code = codes.InvalidArgument
+	case !errors.As(err, &errno):
+		// Not a syscall error: the key or value couldn't be marshalled to
+		// the size the map expects.
+		code = codes.InvalidArgument
+	}
+	return status.Error(code, err.Error())
+}
+
+// Order matters!
+type sendOutcome int
+
+const (
+	SEND_OK     sendOutcome = iota
+	SEND_RETRY              // Transient failure, the same request may succeed later
+	SEND_RESYNC             // The peer missed a change, its map has diverged from ours
+	SEND_DROP               // The request can never succeed on this peer
+)
+
+func (o sendOutcome) String() string {
+	switch o {
+	case SEND_OK:
+		return "OK"
+	case SEND_RETRY:
+		return "RETRY"
+	case SEND_RESYNC:
+		return "RESYNC"
+	case SEND_DROP:
+		return "DROP"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// classifySendError decides what the sender should do about an error returned
+// by a peer's SetValue.
+func classifySendError(err error, op MapUpdater) sendOutcome {
+	switch status.Code(err) {
+	case codes.OK:
+		return SEND_OK
+	case codes.NotFound:
+		// Deleting a key the peer doesn't have leaves both sides in the same state.
+		if op == MAP_DELETE {
+			return SEND_OK
+		}
+		return SEND_RESYNC
+	case codes.ResourceExhausted, codes.AlreadyExists:
+		return SEND_RESYNC
+	case codes.InvalidArgument, codes.Unimplemented, codes.PermissionDenied:
+		return SEND_DROP
+	default:
+		return SEND_RETRY
+	}
+}
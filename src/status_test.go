@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifySendError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		op   MapUpdater
+		want sendOutcome
+	}{
+		{name: "ok", op: MAP_UPDATE, want: SEND_OK},
+		{name: "delete of a missing key", err: status.Error(codes.NotFound, "key does not exist"), op: MAP_DELETE, want: SEND_OK},
+		{name: "update of an unknown map", err: status.Error(codes.NotFound, "no such map"), op: MAP_UPDATE, want: SEND_RESYNC},
+		{name: "map full", err: status.Error(codes.ResourceExhausted, "E2BIG"), op: MAP_UPDATE, want: SEND_RESYNC},
+		{name: "key exists", err: status.Error(codes.AlreadyExists, "key exists"), op: MAP_UPDATE, want: SEND_RESYNC},
+		{name: "bad value", err: status.Error(codes.InvalidArgument, "value size"), op: MAP_UPDATE, want: SEND_DROP},
+		{name: "old peer", err: status.Error(codes.Unimplemented, "unknown method"), op: MAP_UPDATE, want: SEND_DROP},
+		{name: "not permitted", err: status.Error(codes.PermissionDenied, "operation not permitted"), op: MAP_UPDATE, want: SEND_DROP},
+		{name: "not the owner", err: status.Error(codes.Aborted, "owned by b"), op: MAP_DELETE, want: SEND_RETRY},
+		{name: "peer down", err: status.Error(codes.Unavailable, "connection refused"), op: MAP_UPDATE, want: SEND_RETRY},
+		{name: "stale map ID", err: status.Error(codes.FailedPrecondition, "unknown map ID 3"), op: MAP_UPDATE, want: SEND_RETRY},
+		{name: "timeout", err: status.FromContextError(context.DeadlineExceeded).Err(), op: MAP_UPDATE, want: SEND_RETRY},
+		{name: "not a status", err: errors.New("connection reset"), op: MAP_UPDATE, want: SEND_RETRY},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifySendError(tt.err, tt.op); got != tt.want {
+				t.Errorf("classifySendError(%v, %s) = %s, want %s", tt.err, tt.op, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{err: fmt.Errorf("delete: %w", ebpf.ErrKeyNotExist), want: codes.NotFound},
+		{err: fmt.Errorf("update: %w", ebpf.ErrKeyExist), want: codes.AlreadyExists},
+		{err: fmt.Errorf("update: %w", unix.E2BIG), want: codes.ResourceExhausted},
+		{err: fmt.Errorf("update: %w", unix.EPERM), want: codes.PermissionDenied},
+		{err: fmt.Errorf("update: %w", unix.EINVAL), want: codes.InvalidArgument},
+		{err: fmt.Errorf("update: %w", unix.EIO), want: codes.Internal},
+		{err: errors.New("can't marshal key: wrong size"), want: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		if got := status.Code(applyStatus(tt.err)); got != tt.want {
+			t.Errorf("applyStatus(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
@@ -4,6 +4,10 @@
 // - protoc             v3.12.4
 // source: sync_value.proto
 
+// Version 1 of the API. Fields may be added, but never renumbered or given
+// another meaning; anything else goes into a new package. Daemons also serve
+// this service as main.SyncService for peers from before it was versioned.
+
 package main
 
 import (
@@ -19,8 +23,21 @@ import (
 const _ = grpc.SupportPackageIsVersion8
 
 const (
-	SyncService_GetValue_FullMethodName = "/main.SyncService/GetValue"
-	SyncService_SetValue_FullMethodName = "/main.SyncService/SetValue"
+	SyncService_GetValue_FullMethodName        = "/mapsync.v1.SyncService/GetValue"
+	SyncService_SetValue_FullMethodName        = "/mapsync.v1.SyncService/SetValue"
+	SyncService_SetValues_FullMethodName       = "/mapsync.v1.SyncService/SetValues"
+	SyncService_Dump_FullMethodName            = "/mapsync.v1.SyncService/Dump"
+	SyncService_Restore_FullMethodName         = "/mapsync.v1.SyncService/Restore"
+	SyncService_Reload_FullMethodName          = "/mapsync.v1.SyncService/Reload"
+	SyncService_Watch_FullMethodName           = "/mapsync.v1.SyncService/Watch"
+	SyncService_Handshake_FullMethodName       = "/mapsync.v1.SyncService/Handshake"
+	SyncService_Gossip_FullMethodName          = "/mapsync.v1.SyncService/Gossip"
+	SyncService_PingReq_FullMethodName         = "/mapsync.v1.SyncService/PingReq"
+	SyncService_RequestVote_FullMethodName     = "/mapsync.v1.SyncService/RequestVote"
+	SyncService_AppendEntries_FullMethodName   = "/mapsync.v1.SyncService/AppendEntries"
+	SyncService_InstallSnapshot_FullMethodName = "/mapsync.v1.SyncService/InstallSnapshot"
+	SyncService_Propose_FullMethodName         = "/mapsync.v1.SyncService/Propose"
+	SyncService_Lookup_FullMethodName          = "/mapsync.v1.SyncService/Lookup"
 )
 
 // SyncServiceClient is the client API for SyncService service.
@@ -29,6 +46,30 @@ const (
 type SyncServiceClient interface {
 	GetValue(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ValueResponse, error)
 	SetValue(ctx context.Context, in *ValueRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Applies changes in order, for peers announcing the batch capability.
+	SetValues(ctx context.Context, in *ValueBatch, opts ...grpc.CallOption) (*Empty, error)
+	Dump(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Snapshot, error)
+	Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*Empty, error)
+	Reload(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ReloadResponse, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (SyncService_WatchClient, error)
+	// Exchanges the protocol version and the maps of each side, before
+	// sending changes.
+	Handshake(ctx context.Context, in *Hello, opts ...grpc.CallOption) (*Hello, error)
+	// Probes the node for cluster membership, exchanging membership updates.
+	Gossip(ctx context.Context, in *GossipMessage, opts ...grpc.CallOption) (*GossipMessage, error)
+	// Asks the node to probe another one on the sender's behalf.
+	PingReq(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*GossipMessage, error)
+	// Raft consensus between the members of raft.members, for maps replicated
+	// with replicate: raft.
+	RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, in *AppendRequest, opts ...grpc.CallOption) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, in *InstallSnapshotRequest, opts ...grpc.CallOption) (*AppendResponse, error)
+	// Commits changes of raft maps in order, and returns once they're applied.
+	// Sent to any member, which forwards it to the leader.
+	Propose(ctx context.Context, in *ProposeRequest, opts ...grpc.CallOption) (*ProposeResponse, error)
+	// Returns the value of a key, for nodes rolling back their change of a key
+	// they don't own.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error)
 }
 
 type syncServiceClient struct {
@@ -59,12 +100,189 @@ func (c *syncServiceClient) SetValue(ctx context.Context, in *ValueRequest, opts
 	return out, nil
 }
 
+func (c *syncServiceClient) SetValues(ctx context.Context, in *ValueBatch, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, SyncService_SetValues_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Dump(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Snapshot, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Snapshot)
+	err := c.cc.Invoke(ctx, SyncService_Dump_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, SyncService_Restore_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Reload(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ReloadResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReloadResponse)
+	err := c.cc.Invoke(ctx, SyncService_Reload_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (SyncService_WatchClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SyncService_ServiceDesc.Streams[0], SyncService_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &syncServiceWatchClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SyncService_WatchClient interface {
+	Recv() (*MapEvent, error)
+	grpc.ClientStream
+}
+
+type syncServiceWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *syncServiceWatchClient) Recv() (*MapEvent, error) {
+	m := new(MapEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *syncServiceClient) Handshake(ctx context.Context, in *Hello, opts ...grpc.CallOption) (*Hello, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Hello)
+	err := c.cc.Invoke(ctx, SyncService_Handshake_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Gossip(ctx context.Context, in *GossipMessage, opts ...grpc.CallOption) (*GossipMessage, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GossipMessage)
+	err := c.cc.Invoke(ctx, SyncService_Gossip_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) PingReq(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*GossipMessage, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GossipMessage)
+	err := c.cc.Invoke(ctx, SyncService_PingReq_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VoteResponse)
+	err := c.cc.Invoke(ctx, SyncService_RequestVote_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) AppendEntries(ctx context.Context, in *AppendRequest, opts ...grpc.CallOption) (*AppendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendResponse)
+	err := c.cc.Invoke(ctx, SyncService_AppendEntries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) InstallSnapshot(ctx context.Context, in *InstallSnapshotRequest, opts ...grpc.CallOption) (*AppendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendResponse)
+	err := c.cc.Invoke(ctx, SyncService_InstallSnapshot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Propose(ctx context.Context, in *ProposeRequest, opts ...grpc.CallOption) (*ProposeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProposeResponse)
+	err := c.cc.Invoke(ctx, SyncService_Propose_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncServiceClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LookupResponse)
+	err := c.cc.Invoke(ctx, SyncService_Lookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SyncServiceServer is the server API for SyncService service.
 // All implementations must embed UnimplementedSyncServiceServer
 // for forward compatibility
 type SyncServiceServer interface {
 	GetValue(context.Context, *Empty) (*ValueResponse, error)
 	SetValue(context.Context, *ValueRequest) (*Empty, error)
+	// Applies changes in order, for peers announcing the batch capability.
+	SetValues(context.Context, *ValueBatch) (*Empty, error)
+	Dump(context.Context, *Empty) (*Snapshot, error)
+	Restore(context.Context, *RestoreRequest) (*Empty, error)
+	Reload(context.Context, *Empty) (*ReloadResponse, error)
+	Watch(*WatchRequest, SyncService_WatchServer) error
+	// Exchanges the protocol version and the maps of each side, before
+	// sending changes.
+	Handshake(context.Context, *Hello) (*Hello, error)
+	// Probes the node for cluster membership, exchanging membership updates.
+	Gossip(context.Context, *GossipMessage) (*GossipMessage, error)
+	// Asks the node to probe another one on the sender's behalf.
+	PingReq(context.Context, *PingRequest) (*GossipMessage, error)
+	// Raft consensus between the members of raft.members, for maps replicated
+	// with replicate: raft.
+	RequestVote(context.Context, *VoteRequest) (*VoteResponse, error)
+	AppendEntries(context.Context, *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(context.Context, *InstallSnapshotRequest) (*AppendResponse, error)
+	// Commits changes of raft maps in order, and returns once they're applied.
+	// Sent to any member, which forwards it to the leader.
+	Propose(context.Context, *ProposeRequest) (*ProposeResponse, error)
+	// Returns the value of a key, for nodes rolling back their change of a key
+	// they don't own.
+	Lookup(context.Context, *LookupRequest) (*LookupResponse, error)
 	mustEmbedUnimplementedSyncServiceServer()
 }
 
@@ -78,6 +296,45 @@ func (UnimplementedSyncServiceServer) GetValue(context.Context, *Empty) (*ValueR
 func (UnimplementedSyncServiceServer) SetValue(context.Context, *ValueRequest) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SetValue not implemented")
 }
+func (UnimplementedSyncServiceServer) SetValues(context.Context, *ValueBatch) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetValues not implemented")
+}
+func (UnimplementedSyncServiceServer) Dump(context.Context, *Empty) (*Snapshot, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Dump not implemented")
+}
+func (UnimplementedSyncServiceServer) Restore(context.Context, *RestoreRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedSyncServiceServer) Reload(context.Context, *Empty) (*ReloadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedSyncServiceServer) Watch(*WatchRequest, SyncService_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedSyncServiceServer) Handshake(context.Context, *Hello) (*Hello, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Handshake not implemented")
+}
+func (UnimplementedSyncServiceServer) Gossip(context.Context, *GossipMessage) (*GossipMessage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Gossip not implemented")
+}
+func (UnimplementedSyncServiceServer) PingReq(context.Context, *PingRequest) (*GossipMessage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PingReq not implemented")
+}
+func (UnimplementedSyncServiceServer) RequestVote(context.Context, *VoteRequest) (*VoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestVote not implemented")
+}
+func (UnimplementedSyncServiceServer) AppendEntries(context.Context, *AppendRequest) (*AppendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
+}
+func (UnimplementedSyncServiceServer) InstallSnapshot(context.Context, *InstallSnapshotRequest) (*AppendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InstallSnapshot not implemented")
+}
+func (UnimplementedSyncServiceServer) Propose(context.Context, *ProposeRequest) (*ProposeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Propose not implemented")
+}
+func (UnimplementedSyncServiceServer) Lookup(context.Context, *LookupRequest) (*LookupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
 func (UnimplementedSyncServiceServer) mustEmbedUnimplementedSyncServiceServer() {}
 
 // UnsafeSyncServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -127,11 +384,248 @@ func _SyncService_SetValue_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _SyncService_SetValues_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValueBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).SetValues(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_SetValues_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).SetValues(ctx, req.(*ValueBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Dump_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Dump(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Dump_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Dump(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Restore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Restore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Restore_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Restore(ctx, req.(*RestoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Reload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Reload_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Reload(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SyncServiceServer).Watch(m, &syncServiceWatchServer{ServerStream: stream})
+}
+
+type SyncService_WatchServer interface {
+	Send(*MapEvent) error
+	grpc.ServerStream
+}
+
+type syncServiceWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *syncServiceWatchServer) Send(m *MapEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _SyncService_Handshake_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Hello)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Handshake(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Handshake_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Handshake(ctx, req.(*Hello))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Gossip_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GossipMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Gossip(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Gossip_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Gossip(ctx, req.(*GossipMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_PingReq_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).PingReq(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_PingReq_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).PingReq(ctx, req.(*PingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_RequestVote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).RequestVote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_RequestVote_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).RequestVote(ctx, req.(*VoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_AppendEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).AppendEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_AppendEntries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).AppendEntries(ctx, req.(*AppendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_InstallSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InstallSnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).InstallSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_InstallSnapshot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).InstallSnapshot(ctx, req.(*InstallSnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Propose_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProposeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Propose(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Propose_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Propose(ctx, req.(*ProposeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncService_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncServiceServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncService_Lookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncServiceServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // SyncService_ServiceDesc is the grpc.ServiceDesc for SyncService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var SyncService_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "main.SyncService",
+	ServiceName: "mapsync.v1.SyncService",
 	HandlerType: (*SyncServiceServer)(nil),
 	Methods: []grpc.MethodDesc{
 		{
@@ -142,7 +636,61 @@ var SyncService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SetValue",
 			Handler:    _SyncService_SetValue_Handler,
 		},
+		{
+			MethodName: "SetValues",
+			Handler:    _SyncService_SetValues_Handler,
+		},
+		{
+			MethodName: "Dump",
+			Handler:    _SyncService_Dump_Handler,
+		},
+		{
+			MethodName: "Restore",
+			Handler:    _SyncService_Restore_Handler,
+		},
+		{
+			MethodName: "Reload",
+			Handler:    _SyncService_Reload_Handler,
+		},
+		{
+			MethodName: "Handshake",
+			Handler:    _SyncService_Handshake_Handler,
+		},
+		{
+			MethodName: "Gossip",
+			Handler:    _SyncService_Gossip_Handler,
+		},
+		{
+			MethodName: "PingReq",
+			Handler:    _SyncService_PingReq_Handler,
+		},
+		{
+			MethodName: "RequestVote",
+			Handler:    _SyncService_RequestVote_Handler,
+		},
+		{
+			MethodName: "AppendEntries",
+			Handler:    _SyncService_AppendEntries_Handler,
+		},
+		{
+			MethodName: "InstallSnapshot",
+			Handler:    _SyncService_InstallSnapshot_Handler,
+		},
+		{
+			MethodName: "Propose",
+			Handler:    _SyncService_Propose_Handler,
+		},
+		{
+			MethodName: "Lookup",
+			Handler:    _SyncService_Lookup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _SyncService_Watch_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "sync_value.proto",
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// Change is a change from a peer on its way to a local map.
+type Change struct {
+	Map    string
+	Op     MapUpdater
+	Key    []byte
+	Value  []byte // Empty for a delete
+	Origin string
+	// Local returns the value of Key in the local map, nil if it has none.
+	Local func() ([]byte, error)
+}
+
+// Transform rewrites changes from peers before they're applied, e.g. the
+// fields holding an ifindex or an address only meaningful on the sender.
+type Transform interface {
+	// Apply rewrites the key and value of c in place, keeping their size. The
+	// change is refused if it returns an error.
+	Apply(c *Change) error
+}
+
+// transformTypes creates the Transform of every type of transform config,
+// given the layout of the map it applies to, nil if it has no BTF. Other
+// transforms are added with registerTransform, typically from an init
+// function in their own file.
+var transformTypes = map[string]func(TransformConfig, *mapLayout) (Transform, error){}
+
+func registerTransform(typ string, newTransform func(TransformConfig, *mapLayout) (Transform, error)) {
+	transformTypes[typ] = newTransform
+}
+
+func init() {
+	registerTransform(TRANSFORM_SET, newFieldTransform)
+	registerTransform(TRANSFORM_ZERO, newFieldTransform)
+	registerTransform(TRANSFORM_KEEP, newFieldTransform)
+}
+
+func newTransform(tc TransformConfig, layout *mapLayout) (Transform, error) {
+	newTransform, ok := transformTypes[tc.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform type %q", tc.Type)
+	}
+	return newTransform(tc, layout)
+}
+
+// fieldTransform rewrites the bytes of a field of the key or value.
+type fieldTransform struct {
+	typ    string
+	inKey  bool
+	offset int
+	size   int
+	value  []byte // For set
+}
+
+func newFieldTransform(tc TransformConfig, layout *mapLayout) (Transform, error) {
+	t := &fieldTransform{typ: tc.Type, inKey: tc.In == "key"}
+	var typ btf.Type
+	if layout != nil {
+		typ = layout.Value
+		if t.inKey {
+			typ = layout.Key
+		}
+	}
+	if typ == nil {
+		return nil, fmt.Errorf("the map has no BTF to find field %s in", tc.Field)
+	}
+	offset, ft, err := fieldOf(typ, tc.Field)
+	if err != nil {
+		return nil, err
+	}
+	if t.size, err = btf.Sizeof(ft); err != nil {
+		return nil, fmt.Errorf("field %s: %w", tc.Field, err)
+	}
+	t.offset = offset
+	if tc.Type == TRANSFORM_SET {
+		if t.value, err = encodeField(tc.Value, t.size); err != nil {
+			return nil, fmt.Errorf("value: %w", err)
+		}
+	}
+	return t, nil
+}
+
+func (t *fieldTransform) Apply(c *Change) error {
+	b := c.Value
+	if t.inKey {
+		b = c.Key
+	} else if c.Op == MAP_DELETE {
+		return nil
+	}
+	if t.offset+t.size > len(b) {
+		return fmt.Errorf("the field ends past the %d bytes of the change", len(b))
+	}
+	field := b[t.offset : t.offset+t.size]
+	switch t.typ {
+	case TRANSFORM_SET:
+		copy(field, t.value)
+	case TRANSFORM_ZERO:
+		clear(field)
+	case TRANSFORM_KEEP:
+		local, err := c.Local()
+		if err != nil {
+			return err
+		}
+		if len(local) < t.offset+t.size {
+			clear(field)
+		} else {
+			copy(field, local[t.offset:t.offset+t.size])
+		}
+	}
+	return nil
+}
+
+// transform runs the transforms of sm on a change from a peer, and returns
+// the key and value to apply. key and value are left untouched.
+func (sm *syncedMap) transform(op MapUpdater, key, value []byte, origin string) ([]byte, []byte, error) {
+	if len(sm.transforms) == 0 {
+		return key, value, nil
+	}
+	c := &Change{Map: sm.cfg.Name, Op: op, Key: bytes.Clone(key), Value: bytes.Clone(value), Origin: origin}
+	c.Local = func() ([]byte, error) { return sm.m.LookupBytes(c.Key) }
+	for i, t := range sm.transforms {
+		size := [2]int{len(c.Key), len(c.Value)}
+		if err := t.Apply(c); err != nil {
+			return nil, nil, fmt.Errorf("transforms[%d]: %w", i, err)
+		}
+		if size != [2]int{len(c.Key), len(c.Value)} {
+			return nil, nil, fmt.Errorf("transforms[%d] resized the key or value", i)
+		}
+	}
+	return c.Key, c.Value, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// testFlowLayout is a map of flows by ID, with the interface they came in on,
+// their source address and a byte counter.
+func testFlowLayout() *mapLayout {
+	u32 := &btf.Int{Name: "__u32", Size: 4}
+	u64 := &btf.Int{Name: "__u64", Size: 8}
+	return &mapLayout{
+		Key: &btf.Struct{Name: "flow_id", Size: 4, Members: []btf.Member{{Name: "id", Type: u32}}},
+		Value: &btf.Struct{Name: "flow", Size: 16, Members: []btf.Member{
+			{Name: "ifindex", Type: u32},
+			{Name: "saddr", Type: u32, Offset: 32},
+			{Name: "bytes", Type: u64, Offset: 64},
+		}},
+	}
+}
+
+func flowValue(ifindex uint32, saddr [4]byte, bytes uint64) []byte {
+	b := binary.NativeEndian.AppendUint32(nil, ifindex)
+	b = append(b, saddr[:]...)
+	return binary.NativeEndian.AppendUint64(b, bytes)
+}
+
+func TestFieldTransform(t *testing.T) {
+	key := binary.NativeEndian.AppendUint32(nil, 1)
+	local := flowValue(3, [4]byte{192, 168, 0, 1}, 10)
+	tests := []struct {
+		name      string
+		tc        TransformConfig
+		op        MapUpdater
+		local     []byte
+		localErr  error
+		value     []byte
+		wantKey   []byte
+		wantValue []byte
+		wantErr   bool
+	}{
+		{
+			name:      "set number",
+			tc:        TransformConfig{Type: TRANSFORM_SET, Field: "ifindex", Value: "7"},
+			value:     flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantValue: flowValue(7, [4]byte{10, 0, 0, 1}, 100),
+		},
+		{
+			name:      "set address",
+			tc:        TransformConfig{Type: TRANSFORM_SET, Field: "saddr", Value: "10.0.0.9"},
+			value:     flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantValue: flowValue(2, [4]byte{10, 0, 0, 9}, 100),
+		},
+		{
+			name:      "zero",
+			tc:        TransformConfig{Type: TRANSFORM_ZERO, Field: "bytes"},
+			value:     flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantValue: flowValue(2, [4]byte{10, 0, 0, 1}, 0),
+		},
+		{
+			name:      "zero in key",
+			tc:        TransformConfig{Type: TRANSFORM_ZERO, In: "key", Field: "id"},
+			value:     flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantKey:   make([]byte, 4),
+			wantValue: flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+		},
+		{
+			name:      "keep",
+			tc:        TransformConfig{Type: TRANSFORM_KEEP, Field: "ifindex"},
+			local:     local,
+			value:     flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantValue: flowValue(3, [4]byte{10, 0, 0, 1}, 100),
+		},
+		{
+			name:      "keep without a local entry",
+			tc:        TransformConfig{Type: TRANSFORM_KEEP, Field: "ifindex"},
+			value:     flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantValue: flowValue(0, [4]byte{10, 0, 0, 1}, 100),
+		},
+		{
+			name:     "keep with a failed lookup",
+			tc:       TransformConfig{Type: TRANSFORM_KEEP, Field: "ifindex"},
+			localErr: errors.New("lookup failed"),
+			value:    flowValue(2, [4]byte{10, 0, 0, 1}, 100),
+			wantErr:  true,
+		},
+		{
+			name: "delete",
+			tc:   TransformConfig{Type: TRANSFORM_ZERO, Field: "bytes"},
+			op:   MAP_DELETE,
+		},
+		{
+			name:    "short value",
+			tc:      TransformConfig{Type: TRANSFORM_ZERO, Field: "bytes"},
+			value:   make([]byte, 8),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransform(tt.tc, testFlowLayout())
+			if err != nil {
+				t.Fatalf("creating transform: %v", err)
+			}
+			c := &Change{Map: "flows", Op: tt.op, Key: bytes.Clone(key), Value: bytes.Clone(tt.value), Origin: "b"}
+			c.Local = func() ([]byte, error) { return tt.local, tt.localErr }
+			err = tr.Apply(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			wantKey := tt.wantKey
+			if wantKey == nil {
+				wantKey = key
+			}
+			if !bytes.Equal(c.Key, wantKey) {
+				t.Errorf("key %x, want %x", c.Key, wantKey)
+			}
+			if !bytes.Equal(c.Value, tt.wantValue) {
+				t.Errorf("value %x, want %x", c.Value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestNewFieldTransformErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		tc     TransformConfig
+		layout *mapLayout
+	}{
+		{name: "no BTF", tc: TransformConfig{Type: TRANSFORM_ZERO, Field: "bytes"}},
+		{name: "unknown field", tc: TransformConfig{Type: TRANSFORM_ZERO, Field: "daddr"}, layout: testFlowLayout()},
+		{name: "address in a number", tc: TransformConfig{Type: TRANSFORM_SET, Field: "bytes", Value: "10.0.0.1"}, layout: testFlowLayout()},
+		{name: "number too large", tc: TransformConfig{Type: TRANSFORM_SET, Field: "ifindex", Value: "4294967296"}, layout: testFlowLayout()},
+		{name: "unknown type", tc: TransformConfig{Type: "rotate", Field: "bytes"}, layout: testFlowLayout()},
+	}
+	for _, tt := range tests {
+		if _, err := newTransform(tt.tc, tt.layout); err == nil {
+			t.Errorf("%s: transform created", tt.name)
+		}
+	}
+}
+
+func TestSyncedMapTransform(t *testing.T) {
+	layout := testFlowLayout()
+	sm := &syncedMap{cfg: MapConfig{Name: "flows"}, layout: layout}
+	for _, tc := range []TransformConfig{
+		{Type: TRANSFORM_SET, Field: "ifindex", Value: "7"},
+		{Type: TRANSFORM_ZERO, Field: "bytes"},
+	} {
+		tr, err := newTransform(tc, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm.transforms = append(sm.transforms, tr)
+	}
+
+	key := binary.NativeEndian.AppendUint32(nil, 1)
+	value := flowValue(2, [4]byte{10, 0, 0, 1}, 100)
+	sent := bytes.Clone(value)
+	_, got, err := sm.transform(MAP_UPDATE, key, value, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := flowValue(7, [4]byte{10, 0, 0, 1}, 0); !bytes.Equal(got, want) {
+		t.Errorf("value %x, want %x", got, want)
+	}
+	if !bytes.Equal(value, sent) {
+		t.Error("the change as sent was modified")
+	}
+}
@@ -1,7 +1,23 @@
 package main
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+)
+
 const BPF_NAME_LEN = 16
 
+// Changes of maps with larger keys or values are not reported, see bpf/sync.h.
+const (
+	MAX_KEY_SIZE   = 64
+	MAX_VALUE_SIZE = 256
+)
+
 // Order matters!
 type MapUpdater int32
 
@@ -22,8 +38,18 @@ type MapData struct {
 	PID        uint32
 	KeySize    uint32
 	ValueSize  uint32
-	Key        uint32
-	Value      uint32
+	Key        [MAX_KEY_SIZE]byte
+	Value      [MAX_VALUE_SIZE]byte
+}
+
+// KeyBytes returns the key in the map's byte layout.
+func (e *MapData) KeyBytes() []byte {
+	return e.Key[:min(e.KeySize, MAX_KEY_SIZE)]
+}
+
+// ValueBytes returns the value in the map's byte layout, empty for a delete.
+func (e *MapData) ValueBytes() []byte {
+	return e.Value[:min(e.ValueSize, MAX_VALUE_SIZE)]
 }
 
 func (e MapUpdater) String() string {
@@ -36,3 +62,70 @@ func (e MapUpdater) String() string {
 		return "UNKNOWN"
 	}
 }
+
+// cString returns the NUL terminated string at the start of b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// newValueRequest builds the request sending a change of sm to a peer. The
+// map is named here, and translated to the peer's ID for it when sent. Peers
+// from before keys and values were sent as bytes only read 32-bit integers,
+// so those are filled in as well when the sizes allow it.
+func newValueRequest(sm *syncedMap, op MapUpdater, key, value []byte, origin string) *ValueRequest {
+	req := &ValueRequest{
+		Type:      int32(op),
+		Mapid:     int32(sm.id),
+		Map:       sm.cfg.Name,
+		Origin:    origin,
+		KeyData:   key,
+		ValueData: value,
+	}
+	if len(key) == 4 {
+		req.Key = int32(binary.NativeEndian.Uint32(key))
+	}
+	if len(value) == 4 {
+		req.Value = int32(binary.NativeEndian.Uint32(value))
+	}
+	return req
+}
+
+// requestKeyValue returns the key and value of req in the map's byte layout.
+func requestKeyValue(req *ValueRequest) (key, value []byte) {
+	key, value = req.GetKeyData(), req.GetValueData()
+	if key == nil {
+		key = binary.NativeEndian.AppendUint32(nil, uint32(req.GetKey()))
+	}
+	if value == nil && MapUpdater(req.GetType()) == MAP_UPDATE {
+		value = binary.NativeEndian.AppendUint32(nil, uint32(req.GetValue()))
+	}
+	return key, value
+}
+
+// findMapByName returns the first map loaded in the kernel with the given name.
+func findMapByName(name string) (*ebpf.Map, error) {
+	var id ebpf.MapID
+	for {
+		var err error
+		id, err = ebpf.MapGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no map named %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			// The map may have been removed in the meantime.
+			continue
+		}
+		info, err := m.Info()
+		if err == nil && info.Name == name {
+			return m, nil
+		}
+		m.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Events a watcher can fall behind by before its stream is ended.
+const watchBuffer = 1024
+
+// watcher is a client of the Watch RPC.
+type watcher struct {
+	filter *WatchRequest
+	events chan *MapEvent
+	// Closed when the watcher fell behind and was dropped.
+	lagged chan struct{}
+}
+
+func (w *watcher) matches(e *MapEvent) bool {
+	f := w.filter
+	return (len(f.GetMaps()) == 0 || slices.Contains(f.GetMaps(), e.GetMap())) &&
+		bytes.HasPrefix(e.GetKey(), f.GetKeyPrefix()) &&
+		(len(f.GetTypes()) == 0 || slices.Contains(f.GetTypes(), e.GetType())) &&
+		(len(f.GetOrigins()) == 0 || slices.Contains(f.GetOrigins(), e.GetOrigin()))
+}
+
+// watchHub fans out changes to the watchers. Publishing never blocks: a
+// watcher whose buffer is full is dropped.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func (h *watchHub) subscribe(filter *WatchRequest) *watcher {
+	w := &watcher{filter: filter, events: make(chan *MapEvent, watchBuffer), lagged: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	watchClients.Add(1)
+	return w
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		watchClients.Add(-1)
+	}
+}
+
+// active reports whether anyone is watching, to skip building events otherwise.
+func (h *watchHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.watchers) > 0
+}
+
+func (h *watchHub) publish(e *MapEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		if !w.matches(e) {
+			continue
+		}
+		select {
+		case w.events <- e:
+		default:
+			delete(h.watchers, w)
+			watchClients.Add(-1)
+			close(w.lagged)
+		}
+	}
+}
+
+func (n *Node) Watch(in *WatchRequest, stream SyncService_WatchServer) error {
+	w := n.watchers.subscribe(in)
+	defer n.watchers.unsubscribe(w)
+	for {
+		select {
+		case e := <-w.events:
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		case <-w.lagged:
+			return status.Errorf(codes.ResourceExhausted, "watcher fell more than %d changes behind", watchBuffer)
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// watchCommand implements `map-sync watch`, printing changes as the daemon applies them.
+func watchCommand(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:50051", "Address of the daemon to watch")
+	maps := fs.String("map", "", "Comma separated maps to watch, all by default")
+	prefix := fs.String("prefix", "", "Only show keys starting with these bytes, in hex")
+	op := fs.String("op", "", "Only show UPDATE or DELETE changes")
+	origins := fs.String("origin", "", "Comma separated nodes the changes must come from")
+	asJSON := fs.Bool("json", false, "Print changes as JSON lines")
+	tlsConfig := tlsFlags(fs)
+	fs.Parse(args)
+
+	req := &WatchRequest{}
+	if *maps != "" {
+		req.Maps = strings.Split(*maps, ",")
+	}
+	if *origins != "" {
+		req.Origins = strings.Split(*origins, ",")
+	}
+	var err error
+	if req.KeyPrefix, err = hex.DecodeString(*prefix); err != nil {
+		log.Fatalf("Invalid -prefix: %v", err)
+	}
+	switch strings.ToUpper(*op) {
+	case "":
+	case UPDATE:
+		req.Types = []int32{int32(MAP_UPDATE)}
+	case DELETE:
+		req.Types = []int32{int32(MAP_DELETE)}
+	default:
+		log.Fatalf("Invalid -op %q, expected UPDATE or DELETE", *op)
+	}
+
+	client, conn := dialDaemon(*addr, tlsConfig)
+	defer conn.Close()
+	stream, err := client.Watch(context.Background(), req)
+	if err != nil {
+		log.Fatalf("Failed to watch: %v", err)
+	}
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("Watch ended: %v", err)
+		}
+		if *asJSON {
+			line, _ := json.Marshal(e)
+			fmt.Println(string(line))
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\tkey=%s value=%s%s\n", time.Unix(0, e.GetTime()).Format(time.RFC3339Nano),
+			e.GetOrigin(), e.GetMap(), MapUpdater(e.GetType()), e.GetKeyText(), e.GetValueText(), filteredMark(e.GetFiltered()))
+	}
+}
+
+// filteredMark ends the line of a change kept from peers by a filter.
+func filteredMark(filtered bool) string {
+	if filtered {
+		return " (filtered)"
+	}
+	return ""
+}